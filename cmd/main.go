@@ -18,30 +18,40 @@ package main
 
 import (
 	"context"
+	"flag"
 	"media-streaming-mesh/msm-admission-webhook/internal/webhook"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 )
 
-var logger *log.Logger
+var (
+	logger     *log.Logger
+	configFile = flag.String("config", os.Getenv("CONFIG_FILE"), "path of the YAML config file")
+)
 
-// initializes the logger
+// initializes the logger and the config flags
 func init() {
 	logger = log.New()
-	setLogLvl(logger)
-	setLogType(logger)
 	// Output to stdout instead of the default stderr
 	logger.SetOutput(os.Stdout)
-	webhook.IgnoredNamespaces = append(webhook.IgnoredNamespaces, os.Getenv("IGNORED_NAMESPACE"))
-	webhook.MsmWHConfigName = os.Getenv("WEBHOOK_CONFIG_NAME")
+	webhook.RegisterConfigFlags(flag.CommandLine)
 }
 
 // main entry point of msm-webhook application
 func main() {
+	flag.Parse()
+	config, err := webhook.LoadConfig(*configFile, flag.CommandLine)
+	if err != nil {
+		logger.Fatalf("Invalid configuration: %v", err)
+	}
+	webhook.ConfigureLogger(logger, config.Log)
+	webhook.SetConfig(config)
+
 	logger.Info("Starting MSM Admission Webhook")
 
 	// Capture signals and block before exit
@@ -59,15 +69,16 @@ func main() {
 			d.Log = logger
 		}))
 
-	err := w.Init(ctx)
+	err = w.Init(ctx)
 	if err != nil {
 		logger.Fatalf("Could not initialize admission webhook, aborting with error=%s", err)
 	}
+	go w.WatchConfig(ctx, *configFile, flag.CommandLine)
 
 	livenessMux := http.NewServeMux()
-	livenessMux.HandleFunc("/livenessz", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
+	livenessMux.HandleFunc("/livenessz", probe(w.Alive))
+	livenessMux.HandleFunc("/readyz", probe(w.Ready))
+	livenessMux.Handle("/metrics", promhttp.Handler())
 	go func() {
 		logger.Info("Starting Liveness server")
 		err := http.ListenAndServe(":8080", livenessMux)
@@ -92,43 +103,13 @@ func main() {
 	}
 }
 
-// sets the log level of the logger
-func setLogLvl(l *log.Logger) {
-	logLevel := os.Getenv("LOG_LVL")
-
-	switch logLevel {
-	case "DEBUG":
-		l.SetLevel(log.DebugLevel)
-	case "WARN":
-		l.SetLevel(log.WarnLevel)
-	case "INFO":
-		l.SetLevel(log.InfoLevel)
-	case "ERROR":
-		l.SetLevel(log.ErrorLevel)
-	case "TRACE":
-		l.SetLevel(log.TraceLevel)
-	case "FATAL":
-		log.SetLevel(log.FatalLevel)
-	default:
-		l.SetLevel(log.DebugLevel)
-	}
-}
-
-// sets the log type of the logger
-func setLogType(l *log.Logger) {
-	logType := os.Getenv("LOG_TYPE")
-
-	switch logType {
-	case "JSON":
-		l.SetFormatter(&log.JSONFormatter{
-			PrettyPrint: true,
-		})
-	default:
-		l.SetFormatter(&log.TextFormatter{
-			ForceColors:     true,
-			DisableColors:   false,
-			FullTimestamp:   true,
-			TimestampFormat: "2006-01-02 15:04:05",
-		})
+// probe answers a health check with 503 and the reason when check fails
+func probe(check func() error) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
 	}
 }
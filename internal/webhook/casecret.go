@@ -0,0 +1,516 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+var errCASecretInvalid = errors.New("invalid CA secret")
+
+// caSecret is the content of the CA Secret. The signing CA issues the serving
+// certificates, the bundle lists every CA the API server must trust. During a
+// CA rotation the next CA is staged in the bundle before it signs anything.
+type caSecret struct {
+	caPEM     []byte
+	keyPEM    []byte
+	nextPEM   []byte
+	nextKey   []byte
+	bundlePEM []byte
+	changedAt time.Time
+}
+
+// parseCASecret reads and checks the content of the CA Secret. A Secret in
+// the former single certificate format holds a self-signed certificate, which
+// is a CA trusted on its own.
+func parseCASecret(secret *corev1.Secret) (*caSecret, error) {
+	result := &caSecret{
+		caPEM:     secret.Data[caCertFile],
+		keyPEM:    secret.Data[caKeyFile],
+		nextPEM:   secret.Data[nextCACertFile],
+		nextKey:   secret.Data[nextCAKeyFile],
+		bundlePEM: secret.Data[caBundleFile],
+		changedAt: time.Time{},
+	}
+	if _, ok := secret.Data[caCertFile]; !ok {
+		result.caPEM = secret.Data[corev1.TLSCertKey]
+		result.keyPEM = secret.Data[corev1.TLSPrivateKeyKey]
+		result.bundlePEM = result.caPEM
+	}
+	if _, _, err := parseCA(result.caPEM, result.keyPEM); err != nil {
+		return nil, fmt.Errorf("%w %v/%v: %w", errCASecretInvalid, secret.Namespace, secret.Name, err)
+	}
+	if len(result.nextPEM) > 0 {
+		if _, _, err := parseCA(result.nextPEM, result.nextKey); err != nil {
+			return nil, fmt.Errorf("%w %v/%v: next CA: %w", errCASecretInvalid, secret.Namespace, secret.Name, err)
+		}
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(result.bundlePEM) {
+		return nil, fmt.Errorf("%w %v/%v: empty %v", errCASecretInvalid, secret.Namespace, secret.Name, caBundleFile)
+	}
+	if changedAt, ok := secret.Annotations[caChangedAtAnnotation]; ok {
+		t, err := time.Parse(time.RFC3339, changedAt)
+		if err != nil {
+			return nil, fmt.Errorf("%w %v/%v: %w", errCASecretInvalid, secret.Namespace, secret.Name, err)
+		}
+		result.changedAt = t
+	}
+	return result, nil
+}
+
+// apply writes the content into the Secret
+func (c *caSecret) apply(secret *corev1.Secret) {
+	secret.Data = map[string][]byte{
+		caCertFile:   c.caPEM,
+		caKeyFile:    c.keyPEM,
+		caBundleFile: c.bundlePEM,
+	}
+	switch secret.Type {
+	case "":
+		secret.Type = corev1.SecretTypeOpaque
+	case corev1.SecretTypeTLS:
+		// a migrated Secret keeps its immutable type, and the keys it requires
+		secret.Data[corev1.TLSCertKey] = c.caPEM
+		secret.Data[corev1.TLSPrivateKeyKey] = c.keyPEM
+	}
+	if len(c.nextPEM) > 0 {
+		secret.Data[nextCACertFile] = c.nextPEM
+		secret.Data[nextCAKeyFile] = c.nextKey
+	}
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Annotations[caChangedAtAnnotation] = c.changedAt.UTC().Format(time.RFC3339)
+}
+
+// caStep is the next step of a CA rotation
+type caStep int
+
+const (
+	caKeep caStep = iota
+	caStageNext
+	caSwitchToNext
+	caDropPrevious
+)
+
+// nextStep tells how to move the CA rotation forward at now. A step that
+// changes which CA the API server must trust waits for the grace period, and
+// for trusted to confirm that every webhook caBundle trusts the CA that will
+// be the only one left signing. The error tells why a step is postponed.
+func (c *caSecret) nextStep(now time.Time, renewBefore time.Duration,
+	trusted func(ca *x509.Certificate) error,
+) (caStep, error) {
+	ca, _, err := parseCA(c.caPEM, c.keyPEM)
+	if err != nil {
+		return caKeep, err
+	}
+	bundle, err := parseCerts(c.bundlePEM)
+	if err != nil {
+		return caKeep, err
+	}
+	settled := now.Sub(c.changedAt) > caRotationGrace
+
+	switch {
+	case len(c.nextPEM) > 0:
+		// the next CA signs once it is trusted everywhere
+		next, _, err := parseCA(c.nextPEM, c.nextKey)
+		if err != nil || !settled {
+			return caKeep, err
+		}
+		if err := trusted(next); err != nil {
+			return caKeep, fmt.Errorf("next CA %v: %w", next.Subject.CommonName, err)
+		}
+		return caSwitchToNext, nil
+	case len(bundle) > 1:
+		// every replica re-issued its certificate, drop the old CA
+		if !settled {
+			return caKeep, nil
+		}
+		if err := trusted(ca); err != nil {
+			return caKeep, fmt.Errorf("CA %v: %w", ca.Subject.CommonName, err)
+		}
+		return caDropPrevious, nil
+	case ca.NotAfter.Sub(now) < renewBefore:
+		return caStageNext, nil
+	}
+	return caKeep, nil
+}
+
+// loadCASecret switches to the signing CA of the Secret, and issues a new
+// serving certificate when the signing CA changed
+func (w *MsmWebhook) loadCASecret(secret *corev1.Secret) error {
+	content, err := parseCASecret(secret)
+	if err != nil {
+		return err
+	}
+	ca, key, err := parseCA(content.caPEM, content.keyPEM)
+	if err != nil {
+		return err
+	}
+
+	w.certMu.Lock()
+	caChanged := w.signingCA == nil || !w.signingCA.Equal(ca)
+	w.signingCA = ca
+	w.signingKey = key
+	w.certMu.Unlock()
+
+	if caChanged {
+		w.Log.Infof("Signing CA is %v, valid until %v", ca.Subject.CommonName, ca.NotAfter)
+		return w.renewServingCert(content.bundlePEM)
+	}
+
+	cert, err := w.getCertificate(nil)
+	if err != nil {
+		return err
+	}
+	w.setCertificate(cert, content.bundlePEM)
+	return nil
+}
+
+// renewServingCert issues a new serving certificate with the signing CA, the
+// listener picks it up on the next handshake so no connection is dropped
+func (w *MsmWebhook) renewServingCert(caBundle []byte) error {
+	w.certMu.RLock()
+	ca, key := w.signingCA, w.signingKey
+	if caBundle == nil {
+		caBundle = w.caBundle
+	}
+	w.certMu.RUnlock()
+
+	if ca == nil {
+		return errNoCertificate
+	}
+	cert, err := w.issueServingCert(ca, key, time.Now())
+	if err != nil {
+		return err
+	}
+	w.setCertificate(cert, caBundle)
+	w.Log.Infof("Issued serving certificate valid until %v", cert.Leaf.NotAfter)
+	return nil
+}
+
+// rotateServingCert renews the serving certificate once two thirds of its
+// lifetime have elapsed
+func (w *MsmWebhook) rotateServingCert(ctx context.Context) {
+	for {
+		wait := certRetryInterval
+		if cert, err := w.getCertificate(nil); err == nil {
+			lifetime := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore)
+			wait = time.Until(cert.Leaf.NotBefore.Add(lifetime * 2 / 3))
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if err := w.renewServingCert(nil); err != nil {
+			w.Log.Errorf("Could not renew the serving certificate: %v", err)
+		}
+	}
+}
+
+// waitForCASecret blocks until the leader has created the CA Secret and it
+// has been loaded
+func (w *MsmWebhook) waitForCASecret(ctx context.Context) error {
+	op := func() error {
+		secret, err := w.kube.CoreV1().Secrets(w.namespace).Get(ctx, CASecretName, metav1.GetOptions{
+			TypeMeta:        metav1.TypeMeta{},
+			ResourceVersion: "",
+		})
+		if err != nil {
+			return err
+		}
+		return w.loadCASecret(secret)
+	}
+	return backoff.Retry(op, backoff.WithContext(backoff.NewExponentialBackOff(), ctx))
+}
+
+// watchCASecret reloads the certificate whenever the leader rotates the CA Secret
+func (w *MsmWebhook) watchCASecret(ctx context.Context) {
+	factory := informers.NewSharedInformerFactoryWithOptions(w.kube, 0,
+		informers.WithNamespace(w.namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.FieldSelector = fields.OneTermEqualSelector("metadata.name", CASecretName).String()
+		}))
+
+	reload := func(obj interface{}) {
+		secret, ok := obj.(*corev1.Secret)
+		if !ok {
+			return
+		}
+		if err := w.loadCASecret(secret); err != nil {
+			w.Log.Errorf("Could not reload certificate: %v", err)
+		}
+	}
+
+	//nolint:exhaustruct
+	_, err := factory.Core().V1().Secrets().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    reload,
+		UpdateFunc: func(_, obj interface{}) { reload(obj) },
+	})
+	if err != nil {
+		w.Log.Errorf("Could not watch secret %v/%v: %v", w.namespace, CASecretName, err)
+		return
+	}
+	factory.Start(ctx.Done())
+}
+
+// runLeaderElection elects the replica that owns the CA Secret and the
+// caBundle of the webhook configurations
+//
+//nolint:exhaustruct
+func (w *MsmWebhook) runLeaderElection(ctx context.Context) error {
+	identity, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      LeaseName,
+			Namespace: w.namespace,
+		},
+		Client: w.kube.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   leaseRenewDeadline,
+		RetryPeriod:     leaseRetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: w.lead,
+			OnStoppedLeading: func() {
+				w.Log.Infof("%v stopped leading", identity)
+			},
+			OnNewLeader: func(leader string) {
+				w.Log.Infof("%v is the leader", leader)
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		// keep campaigning after losing the lease until shutdown
+		for ctx.Err() == nil {
+			elector.Run(ctx)
+		}
+	}()
+	return nil
+}
+
+// lead keeps the CA Secret valid and its CA patched into the webhook
+// configurations while this replica holds the lease, only the leader
+// reconciles them so replicas never fight over the caBundle
+func (w *MsmWebhook) lead(ctx context.Context) {
+	w.Log.Info("Started leading, managing the CA secret")
+	w.reconcileWebhookConfigs(ctx)
+
+	ticker := time.NewTicker(caCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.ensureCASecret(ctx); err != nil {
+			w.Log.Errorf("Could not ensure the CA secret: %v", err)
+		} else if err := w.patchWebhookConfigs(ctx); err != nil {
+			w.Log.Errorf("Could not patch the CA bundle: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ensureCASecret creates the CA Secret and walks it through CA rotations:
+// a new CA is first added to the bundle, then signs once the bundle had time
+// to reach the API server, and the old CA leaves the bundle after the
+// replicas had time to re-issue their serving certificates
+//
+//nolint:exhaustruct
+func (w *MsmWebhook) ensureCASecret(ctx context.Context) error {
+	secrets := w.kube.CoreV1().Secrets(w.namespace)
+	now := time.Now()
+
+	secret, err := secrets.Get(ctx, CASecretName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		caPEM, keyPEM, err := w.newCA(now)
+		if err != nil {
+			return err
+		}
+		content := &caSecret{
+			caPEM:     caPEM,
+			keyPEM:    keyPEM,
+			nextPEM:   nil,
+			nextKey:   nil,
+			bundlePEM: caPEM,
+			changedAt: now,
+		}
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      CASecretName,
+				Namespace: w.namespace,
+			},
+		}
+		content.apply(secret)
+		secret, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			// a previous leader created it meanwhile, its CA wins
+			w.Log.Infof("CA secret %v/%v was created concurrently, loading it", w.namespace, CASecretName)
+			if secret, err = secrets.Get(ctx, CASecretName, metav1.GetOptions{}); err != nil {
+				return err
+			}
+			return w.loadCASecret(secret)
+		}
+		if err != nil {
+			return err
+		}
+		w.Log.Infof("Created CA secret %v/%v", w.namespace, CASecretName)
+		return w.loadCASecret(secret)
+	case err != nil:
+		return err
+	}
+
+	content, err := parseCASecret(secret)
+	if err != nil {
+		// nothing to roll over from, start again with a fresh CA
+		w.Log.Warnf("Replacing CA secret: %v", err)
+		caPEM, keyPEM, err := w.newCA(now)
+		if err != nil {
+			return err
+		}
+		content = &caSecret{
+			caPEM:     caPEM,
+			keyPEM:    keyPEM,
+			nextPEM:   nil,
+			nextKey:   nil,
+			bundlePEM: caPEM,
+			changedAt: now,
+		}
+		return w.updateCASecret(ctx, secret, content)
+	}
+	if _, ok := secret.Data[caCertFile]; !ok {
+		// the self-signed certificate keeps signing and stays trusted
+		w.Log.Infof("Migrating CA secret %v/%v from the single certificate format", w.namespace, CASecretName)
+		content.changedAt = now
+		return w.updateCASecret(ctx, secret, content)
+	}
+
+	step, err := content.nextStep(now, w.certOpts.caRenewBefore(), func(ca *x509.Certificate) error {
+		return w.caBundlesTrust(ctx, ca)
+	})
+	if err != nil {
+		w.Log.Infof("Postponing the CA rotation: %v", err)
+	}
+
+	switch step {
+	case caSwitchToNext:
+		w.Log.Infof("Switching to the next CA")
+		content.caPEM, content.keyPEM = content.nextPEM, content.nextKey
+		content.nextPEM, content.nextKey = nil, nil
+		content.changedAt = now
+		return w.updateCASecret(ctx, secret, content)
+	case caDropPrevious:
+		w.Log.Infof("Removing the previous CA from the bundle")
+		content.bundlePEM = content.caPEM
+		content.changedAt = now
+		return w.updateCASecret(ctx, secret, content)
+	case caStageNext:
+		w.Log.Infof("Staging a new CA, the current one is about to expire")
+		nextPEM, nextKey, err := w.newCA(now)
+		if err != nil {
+			return err
+		}
+		content.nextPEM, content.nextKey = nextPEM, nextKey
+		content.bundlePEM = append(append([]byte{}, content.caPEM...), nextPEM...)
+		content.changedAt = now
+		return w.updateCASecret(ctx, secret, content)
+	case caKeep:
+	}
+
+	return w.loadCASecret(secret)
+}
+
+// caBundlesTrust checks that the caBundle of every owned webhook trusts the
+// CA, a managed configuration that does not exist trusts nothing and is skipped
+func (w *MsmWebhook) caBundlesTrust(ctx context.Context, ca *x509.Certificate) error {
+	chain := &tls.Certificate{Certificate: [][]byte{ca.Raw}, Leaf: ca} //nolint:exhaustruct
+	for _, kind := range w.managed.kinds() {
+		names, err := kind.resolve(ctx)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			config, err := kind.get(ctx, name)
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			for _, wh := range w.owned(config) {
+				if err := verifyCABundle(wh.config.CABundle, chain); err != nil {
+					return fmt.Errorf("caBundle of webhook %v in %v: %w", wh.name, name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// updateCASecret writes the content into the CA Secret, a conflicting update
+// fails and the next check works from a fresh read
+//
+//nolint:exhaustruct
+func (w *MsmWebhook) updateCASecret(ctx context.Context, secret *corev1.Secret, content *caSecret) error {
+	content.apply(secret)
+	secret, err := w.kube.CoreV1().Secrets(w.namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+	return w.loadCASecret(secret)
+}
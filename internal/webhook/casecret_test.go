@@ -0,0 +1,288 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+
+	admitv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newCATestWebhook returns a replica sharing the clientset of the others
+func newCATestWebhook(t *testing.T, kube kubernetes.Interface) *MsmWebhook {
+	t.Helper()
+	previous := CASecretName
+	CASecretName = defaultCASecretName
+	t.Cleanup(func() { CASecretName = previous })
+
+	w := newTestWebhook()
+	w.kube = kube
+	w.namespace = "msm"
+	w.certOpts = newCertTestOptions()
+	return w
+}
+
+func getCASecret(t *testing.T, kube kubernetes.Interface) *corev1.Secret {
+	t.Helper()
+	secret, err := kube.CoreV1().Secrets("msm").Get(context.Background(), CASecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+// checkServesCASecret checks that the replica serves a certificate trusted by
+// the bundle of the CA Secret
+func checkServesCASecret(t *testing.T, w *MsmWebhook) {
+	t.Helper()
+	content, err := parseCASecret(getCASecret(t, w.kube))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := w.getCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyCABundle(content.bundlePEM, cert); err != nil {
+		t.Fatalf("served certificate is not trusted by the CA secret: %v", err)
+	}
+}
+
+func TestEnsureCASecretCreates(t *testing.T) {
+	_, clientset := newRegistrationTestWebhook()
+	w := newCATestWebhook(t, clientset)
+
+	if err := w.ensureCASecret(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkServesCASecret(t, w)
+
+	// a second check keeps the CA
+	created := getCASecret(t, clientset)
+	if err := w.ensureCASecret(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := getCASecret(t, clientset); string(got.Data[caCertFile]) != string(created.Data[caCertFile]) {
+		t.Error("expected the CA to be kept")
+	}
+}
+
+func TestEnsureCASecretConcurrentCreate(t *testing.T) {
+	_, clientset := newRegistrationTestWebhook()
+	previous := newCATestWebhook(t, clientset)
+	if err := previous.ensureCASecret(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	existing := getCASecret(t, clientset)
+
+	// the new leader read before the previous one created the Secret
+	w := newCATestWebhook(t, clientset)
+	stale := true
+	clientset.PrependReactor("get", "secrets", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if stale {
+			stale = false
+			return true, nil, apierrors.NewNotFound(corev1.Resource("secrets"), CASecretName)
+		}
+		return false, nil, nil
+	})
+
+	if err := w.ensureCASecret(context.Background()); err != nil {
+		t.Fatalf("expected the concurrently created secret to be loaded, got %v", err)
+	}
+	if got := getCASecret(t, clientset); string(got.Data[caCertFile]) != string(existing.Data[caCertFile]) {
+		t.Error("expected the existing CA to win")
+	}
+	checkServesCASecret(t, w)
+}
+
+func TestWaitForCASecret(t *testing.T) {
+	_, clientset := newRegistrationTestWebhook()
+	follower := newCATestWebhook(t, clientset)
+	leader := newCATestWebhook(t, clientset)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- follower.waitForCASecret(ctx) }()
+
+	time.Sleep(100 * time.Millisecond)
+	if err := leader.ensureCASecret(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("expected the follower to load the secret, got %v", err)
+	}
+	checkServesCASecret(t, follower)
+}
+
+func TestCASecretNextStep(t *testing.T) {
+	w := newCATestWebhook(t, nil)
+	t0 := time.Now()
+	caPEM, keyPEM, err := w.newCA(t0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextPEM, nextKey, err := w.newCA(t0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _, _ := parseCA(caPEM, keyPEM)
+	next, _, _ := parseCA(nextPEM, nextKey)
+	both := append(append([]byte{}, caPEM...), nextPEM...)
+
+	current := func() *caSecret {
+		return &caSecret{caPEM: caPEM, keyPEM: keyPEM, bundlePEM: caPEM, changedAt: t0}
+	}
+	staged := func() *caSecret {
+		c := current()
+		c.nextPEM, c.nextKey, c.bundlePEM = nextPEM, nextKey, both
+		return c
+	}
+	switched := func() *caSecret {
+		c := current()
+		c.caPEM, c.keyPEM, c.bundlePEM = nextPEM, nextKey, both
+		return c
+	}
+	// trusts reports whether the webhook caBundles trust only the given CA
+	trusts := func(want *x509.Certificate) func(*x509.Certificate) error {
+		return func(ca *x509.Certificate) error {
+			if want == nil || !ca.Equal(want) {
+				return errors.New("not trusted")
+			}
+			return nil
+		}
+	}
+	renewBefore := w.certOpts.caRenewBefore()
+	settled := t0.Add(caRotationGrace + time.Minute)
+
+	for _, tc := range []struct {
+		name    string
+		content *caSecret
+		now     time.Time
+		trusted *x509.Certificate
+		want    caStep
+		wantErr bool
+	}{
+		{name: "valid CA is kept", content: current(), now: settled, want: caKeep},
+		{
+			name: "expiring CA stages the next one", content: current(),
+			now: ca.NotAfter.Add(-renewBefore / 2), want: caStageNext,
+		},
+		{name: "staged CA waits for the grace period", content: staged(), now: t0.Add(time.Minute), trusted: next, want: caKeep},
+		{name: "staged CA signs once trusted", content: staged(), now: settled, trusted: next, want: caSwitchToNext},
+		{name: "staged CA waits for the caBundles", content: staged(), now: settled, trusted: ca, want: caKeep, wantErr: true},
+		{name: "previous CA waits for the grace period", content: switched(), now: t0.Add(time.Minute), trusted: next, want: caKeep},
+		{name: "previous CA is dropped once trusted", content: switched(), now: settled, trusted: next, want: caDropPrevious},
+		{name: "previous CA waits for the caBundles", content: switched(), now: settled, want: caKeep, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.content.nextStep(tc.now, renewBefore, trusts(tc.trusted))
+			if got != tc.want {
+				t.Errorf("got step %v, want %v", got, tc.want)
+			}
+			if (err != nil) != tc.wantErr {
+				t.Errorf("got error %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+//nolint:exhaustruct
+func TestEnsureCASecretWaitsForCABundles(t *testing.T) {
+	w := newCATestWebhook(t, nil)
+	t0 := time.Now().Add(-2 * caRotationGrace)
+	caPEM, keyPEM, _ := w.newCA(t0)
+	nextPEM, nextKey, _ := w.newCA(t0)
+	content := &caSecret{
+		caPEM: caPEM, keyPEM: keyPEM, nextPEM: nextPEM, nextKey: nextKey,
+		bundlePEM: append(append([]byte{}, caPEM...), nextPEM...), changedAt: t0,
+	}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: CASecretName, Namespace: "msm"}}
+	content.apply(secret)
+	config := &admitv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "msm-webhook"},
+		Webhooks: []admitv1.MutatingWebhook{{
+			Name:         "msm-webhook.mediastreamingmesh.io",
+			ClientConfig: admitv1.WebhookClientConfig{Service: ownService(), CABundle: caPEM},
+		}},
+	}
+
+	w, clientset := newRegistrationTestWebhook(secret, config)
+	w.certOpts = newCertTestOptions()
+	if err := w.ensureCASecret(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := getCASecret(t, clientset); string(got.Data[caCertFile]) != string(caPEM) {
+		t.Fatal("expected the current CA to keep signing until the caBundle trusts the next one")
+	}
+
+	// once patched, the next CA takes over
+	if err := w.patchWebhookConfigs(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.ensureCASecret(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := getCASecret(t, clientset); string(got.Data[caCertFile]) != string(nextPEM) {
+		t.Fatal("expected the next CA to sign")
+	}
+	checkServesCASecret(t, w)
+}
+
+//nolint:exhaustruct
+func TestEnsureCASecretMigrates(t *testing.T) {
+	w := newCATestWebhook(t, nil)
+	certPEM, keyPEM, err := w.newCA(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: CASecretName, Namespace: "msm"},
+		Type:       corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       certPEM,
+			corev1.TLSPrivateKeyKey: keyPEM,
+		},
+	}
+
+	w, clientset := newRegistrationTestWebhook(legacy)
+	w.certOpts = newCertTestOptions()
+	if err := w.ensureCASecret(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := getCASecret(t, clientset)
+	if got.Type != corev1.SecretTypeTLS {
+		t.Errorf("expected the secret type to be kept, got %v", got.Type)
+	}
+	for _, key := range []string{caCertFile, caBundleFile, corev1.TLSCertKey} {
+		if string(got.Data[key]) != string(certPEM) {
+			t.Errorf("expected %v to hold the former certificate", key)
+		}
+	}
+	checkServesCASecret(t, w)
+}
@@ -0,0 +1,269 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var errNoCertificate = errors.New("no serving certificate loaded")
+
+// getCertificate serves the current certificate, it is swapped on reload
+// without restarting the listener
+func (w *MsmWebhook) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	w.certMu.RLock()
+	defer w.certMu.RUnlock()
+
+	if w.cert == nil {
+		return nil, errNoCertificate
+	}
+	return w.cert, nil
+}
+
+// setCertificate replaces the served certificate and the CA bundle trusted
+// for it, it reports whether the CA bundle changed
+func (w *MsmWebhook) setCertificate(cert *tls.Certificate, caBundle []byte) bool {
+	w.certMu.Lock()
+	defer w.certMu.Unlock()
+
+	changed := !bytes.Equal(w.caBundle, caBundle)
+	w.cert = cert
+	w.caBundle = caBundle
+	return changed
+}
+
+// setCABundle replaces the CA bundle patched into the webhook configurations,
+// the served certificate is left alone
+func (w *MsmWebhook) setCABundle(caBundle []byte) {
+	w.certMu.Lock()
+	defer w.certMu.Unlock()
+
+	w.caBundle = caBundle
+}
+
+// getCABundle returns the CA bundle patched into the webhook configurations
+func (w *MsmWebhook) getCABundle() []byte {
+	w.certMu.RLock()
+	defer w.certMu.RUnlock()
+
+	return w.caBundle
+}
+
+// caNotAfter returns the expiry of the signing CA, or of the longest lived
+// CA of the bundle when the CA is managed elsewhere
+func (w *MsmWebhook) caNotAfter() (time.Time, bool) {
+	w.certMu.RLock()
+	defer w.certMu.RUnlock()
+
+	if w.signingCA != nil {
+		return w.signingCA.NotAfter, true
+	}
+	certs, err := parseCerts(w.caBundle)
+	if err != nil || len(certs) == 0 {
+		return time.Time{}, false
+	}
+	notAfter := certs[0].NotAfter
+	for _, c := range certs[1:] {
+		if c.NotAfter.After(notAfter) {
+			notAfter = c.NotAfter
+		}
+	}
+	return notAfter, true
+}
+
+// loadCertFiles reads the serving certificate mounted from a Secret. The CA
+// bundle is taken from ca.crt when present, from the certificate chain
+// otherwise.
+func loadCertFiles(dir string) (*tls.Certificate, []byte, error) {
+	certPEM, err := os.ReadFile(filepath.Join(dir, tlsCertFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(dir, tlsKeyFile))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid key pair in %v: %w", dir, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid certificate in %v: %w", dir, err)
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return nil, nil, fmt.Errorf("certificate in %v expired at %v", dir, leaf.NotAfter)
+	}
+	cert.Leaf = leaf
+
+	caBundle, err := os.ReadFile(filepath.Join(dir, caCertFile))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		caBundle = certPEM
+	case err != nil:
+		return nil, nil, err
+	case !x509.NewCertPool().AppendCertsFromPEM(caBundle):
+		return nil, nil, fmt.Errorf("no certificate found in %v", filepath.Join(dir, caCertFile))
+	}
+
+	return &cert, caBundle, nil
+}
+
+// certFilesChecksum identifies the content of the mounted certificate files,
+// Secret volumes are updated through symlink swaps so the content is compared
+// rather than modification times
+func certFilesChecksum(dir string) [sha256.Size]byte {
+	h := sha256.New()
+	for _, name := range []string{tlsCertFile, tlsKeyFile, caCertFile} {
+		data, _ := os.ReadFile(filepath.Join(dir, name))
+		h.Write(data)
+		h.Write([]byte{0})
+	}
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// certFiles tracks the mounted certificate files between reloads
+type certFiles struct {
+	dir string
+	// checksum of the files last loaded successfully
+	last [sha256.Size]byte
+	// CA bundle of the files last loaded, the published bundle also keeps
+	// the CA before it while the certificate is swapped
+	caBundle []byte
+}
+
+// watchCertFiles reloads the mounted certificate whenever the files change,
+// and patches the webhook configurations when the CA changed
+func (w *MsmWebhook) watchCertFiles(ctx context.Context, files *certFiles) {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		w.reloadCertFiles(ctx, files)
+	}
+}
+
+// reloadCertFiles swaps the served certificate when the files changed. A new
+// CA is published alongside the previous one before the certificate it signed
+// is served, the files are loaded again on the next tick until that succeeds.
+func (w *MsmWebhook) reloadCertFiles(ctx context.Context, files *certFiles) {
+	sum := certFilesChecksum(files.dir)
+	if sum == files.last {
+		return
+	}
+
+	cert, caBundle, err := loadCertFiles(files.dir)
+	if err != nil {
+		// keep serving the previous certificate, a Secret update may be
+		// half way through
+		w.Log.Errorf("Could not reload certificate from %v: %v", files.dir, err)
+		return
+	}
+
+	switch {
+	case bytes.Equal(caBundle, files.caBundle):
+		w.setCertificate(cert, w.getCABundle())
+	case w.certMode == certModeCertManager:
+		// cert-manager's CA injector publishes the new CA
+		w.setCertificate(cert, caBundle)
+		w.checkCABundles(ctx)
+	default:
+		published, err := mergeCABundles(caBundle, files.caBundle)
+		if err != nil {
+			w.Log.Errorf("Could not reload certificate from %v: %v", files.dir, err)
+			return
+		}
+		w.setCABundle(published)
+		if err := w.patchWebhookConfigs(ctx); err != nil {
+			w.Log.Errorf("Could not publish the new CA, keeping the previous certificate: %v", err)
+			return
+		}
+		w.setCertificate(cert, published)
+	}
+	files.last = sum
+	files.caBundle = caBundle
+	w.Log.Infof("Reloaded certificate from %v, valid until %v", files.dir, cert.Leaf.NotAfter)
+}
+
+// mergeCABundles returns the certificates of the bundles, each once
+func mergeCABundles(bundles ...[]byte) ([]byte, error) {
+	var merged []byte
+	seen := make(map[string]bool)
+	for _, bundle := range bundles {
+		certs, err := parseCerts(bundle)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range certs {
+			if !seen[string(c.Raw)] {
+				seen[string(c.Raw)] = true
+				merged = append(merged, encodeCert(c.Raw)...)
+			}
+		}
+	}
+	return merged, nil
+}
+
+// verifyCABundle checks that the CA bundle trusts the served certificate chain
+func verifyCABundle(caBundle []byte, cert *tls.Certificate) error {
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caBundle) {
+		return errors.New("caBundle contains no certificate")
+	}
+
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, raw := range cert.Certificate[1:] {
+		c, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		intermediates.AddCert(c)
+	}
+
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return err
+}
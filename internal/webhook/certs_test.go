@@ -0,0 +1,180 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	admitv1 "k8s.io/api/admissionregistration/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// writeCertFiles mounts a serving certificate signed by a new CA into dir
+func writeCertFiles(t *testing.T, w *MsmWebhook, dir string) ([]byte, *tls.Certificate) {
+	t.Helper()
+	caPEM, caKeyPEM, err := w.newCA(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, caKey, err := parseCA(caPEM, caKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := w.issueServingCert(ca, caKey, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := encodeKey(cert.PrivateKey.(crypto.Signer)) //nolint:forcetypeassert
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		tlsCertFile: encodeCert(cert.Certificate[0]),
+		tlsKeyFile:  keyPEM,
+		caCertFile:  caPEM,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return caPEM, cert
+}
+
+func sameCert(a, b *tls.Certificate) bool {
+	return a != nil && b != nil && bytes.Equal(a.Certificate[0], b.Certificate[0])
+}
+
+func newCertTestOptions() *certOptions {
+	return &certOptions{
+		keyAlgorithm:  keyAlgorithmECDSA,
+		validity:      time.Hour,
+		caValidity:    24 * time.Hour,
+		serviceName:   msmServiceName,
+		extraDNSNames: nil,
+		extraIPs:      nil,
+		customized:    false,
+	}
+}
+
+//nolint:exhaustruct
+func TestReloadCertFiles(t *testing.T) {
+	dir := t.TempDir()
+	w, clientset := newRegistrationTestWebhook(&admitv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "msm-webhook"},
+		Webhooks: []admitv1.MutatingWebhook{{
+			Name:         "msm-webhook.mediastreamingmesh.io",
+			ClientConfig: admitv1.WebhookClientConfig{Service: ownService()},
+		}},
+	})
+	w.certMode = certModeFile
+	w.certOpts = newCertTestOptions()
+
+	oldCA, oldCert := writeCertFiles(t, w, dir)
+	w.setCertificate(oldCert, oldCA)
+	files := &certFiles{dir: dir, last: certFilesChecksum(dir), caBundle: oldCA}
+	_, newCert := writeCertFiles(t, w, dir)
+
+	// the first publication fails
+	resource := schema.GroupResource{Group: "admissionregistration.k8s.io", Resource: "mutatingwebhookconfigurations"}
+	failing := true
+	var servedDuringPatch *tls.Certificate
+	clientset.PrependReactor("update", "mutatingwebhookconfigurations",
+		func(k8stesting.Action) (bool, runtime.Object, error) {
+			if failing {
+				return true, nil, apierrors.NewForbidden(resource, "msm-webhook", errors.New("rbac"))
+			}
+			servedDuringPatch, _ = w.getCertificate(nil)
+			return false, nil, nil
+		})
+
+	w.reloadCertFiles(context.Background(), files)
+	if served, _ := w.getCertificate(nil); !sameCert(served, oldCert) {
+		t.Fatal("served the new certificate before its CA was published")
+	}
+	if files.last == certFilesChecksum(dir) {
+		t.Fatal("recorded the files as loaded although the CA was not published")
+	}
+
+	failing = false
+	w.reloadCertFiles(context.Background(), files)
+	if served, _ := w.getCertificate(nil); !sameCert(served, newCert) {
+		t.Fatal("expected the new certificate to be served once its CA is published")
+	}
+	if !sameCert(servedDuringPatch, oldCert) {
+		t.Error("expected the CA to be published while the previous certificate is still served")
+	}
+	if files.last != certFilesChecksum(dir) {
+		t.Error("expected the files to be recorded as loaded")
+	}
+
+	config, err := clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().
+		Get(context.Background(), "msm-webhook", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cert := range []*tls.Certificate{oldCert, newCert} {
+		if err := verifyCABundle(config.Webhooks[0].ClientConfig.CABundle, cert); err != nil {
+			t.Errorf("expected the published caBundle to trust both certificates: %v", err)
+		}
+	}
+}
+
+func TestVerifyCABundle(t *testing.T) {
+	w := newTestWebhook()
+	w.certOpts = newCertTestOptions()
+	dir := t.TempDir()
+	caPEM, cert := writeCertFiles(t, w, dir)
+	otherCA, otherCert := writeCertFiles(t, w, dir)
+	both, err := mergeCABundles(otherCA, caPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafOnly := *cert
+	leafOnly.Leaf = nil
+
+	for _, tc := range []struct {
+		name     string
+		caBundle []byte
+		cert     *tls.Certificate
+		ok       bool
+	}{
+		{name: "signing CA", caBundle: caPEM, cert: cert, ok: true},
+		{name: "bundle with the signing CA", caBundle: both, cert: cert, ok: true},
+		{name: "unparsed leaf", caBundle: caPEM, cert: &leafOnly, ok: true},
+		{name: "other CA", caBundle: otherCA, cert: cert, ok: false},
+		{name: "leaf is no CA", caBundle: encodeCert(otherCert.Certificate[0]), cert: cert, ok: false},
+		{name: "empty", caBundle: []byte("ca"), cert: cert, ok: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := verifyCABundle(tc.caBundle, tc.cert); (err == nil) != tc.ok {
+				t.Fatalf("expected ok=%v, got %v", tc.ok, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,454 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+// Config holds every setting of the webhook. It is read from a YAML file,
+// then overridden by the envs and by the command line flags named in the
+// env tags. Only the log and injection settings are reloaded while running,
+// the others apply at startup.
+type Config struct {
+	Log          LogConfig          `json:"log"`
+	Injection    InjectionConfig    `json:"injection"`
+	Registration RegistrationConfig `json:"registration"`
+	Certificates CertificateConfig  `json:"certificates"`
+	TLS          TLSSettings        `json:"tls"`
+	Tracing      TracingConfig      `json:"tracing"`
+
+	// checksum of the file the config was read from, so that a change
+	// between loading and watching the file is not missed
+	checksum [sha256.Size]byte
+}
+
+// LogConfig configures the webhook logger
+type LogConfig struct {
+	Level string `json:"level" env:"LOG_LVL"`
+	Type  string `json:"type"  env:"LOG_TYPE"`
+}
+
+// InjectionConfig configures the injected stub
+type InjectionConfig struct {
+	Repo            string `json:"repo"            env:"REPO"`
+	Tag             string `json:"tag"             env:"TAG"`
+	Sidecar         string `json:"sidecar"         env:"MSM_SIDECAR"`
+	ImagePullPolicy string `json:"imagePullPolicy" env:"IMAGE_PULL_POLICY"`
+	LogLevel        string `json:"logLevel"        env:"MSM_LOG_LVL"`
+	ControlPlane    string `json:"controlPlane"    env:"MSM_CONTROL_PLANE"`
+	DataPlane       string `json:"dataPlane"       env:"MSM_DATA_PLANE"`
+	Warnings        string `json:"warnings"        env:"MSM_WARNINGS"`
+	// ignored on top of kube-system and kube-public
+	IgnoredNamespaces []string `json:"ignoredNamespaces" env:"IGNORED_NAMESPACE"`
+	// name of the ConfigMap overriding these settings in its namespace,
+	// read at startup only
+	NamespaceConfigMap string `json:"namespaceConfigMap" env:"MSM_NAMESPACE_CONFIGMAP"`
+}
+
+// RegistrationConfig configures the managed webhook configurations
+type RegistrationConfig struct {
+	Mode                 string `json:"mode"                 env:"WEBHOOK_REGISTRATION"`
+	MutatingConfigName   string `json:"mutatingConfigName"   env:"WEBHOOK_CONFIG_NAME"`
+	ValidatingConfigName string `json:"validatingConfigName" env:"VALIDATING_WEBHOOK_CONFIG_NAME"`
+	MutatingConfigs      string `json:"mutatingConfigs"      env:"MUTATING_WEBHOOK_CONFIGS"`
+	ValidatingConfigs    string `json:"validatingConfigs"    env:"VALIDATING_WEBHOOK_CONFIGS"`
+	MutatingSelector     string `json:"mutatingSelector"     env:"MUTATING_WEBHOOK_SELECTOR"`
+	ValidatingSelector   string `json:"validatingSelector"   env:"VALIDATING_WEBHOOK_SELECTOR"`
+	ServiceName          string `json:"serviceName"          env:"SERVICE_NAME"`
+	FailurePolicy        string `json:"failurePolicy"        env:"WEBHOOK_FAILURE_POLICY"`
+	TimeoutSeconds       string `json:"timeoutSeconds"       env:"WEBHOOK_TIMEOUT_SECONDS"`
+	SideEffects          string `json:"sideEffects"          env:"WEBHOOK_SIDE_EFFECTS"`
+	ReinvocationPolicy   string `json:"reinvocationPolicy"   env:"WEBHOOK_REINVOCATION_POLICY"`
+	NamespaceSelector    string `json:"namespaceSelector"    env:"WEBHOOK_NAMESPACE_SELECTOR"`
+	ObjectSelector       string `json:"objectSelector"       env:"WEBHOOK_OBJECT_SELECTOR"`
+	ShutdownPolicy       string `json:"shutdownPolicy"       env:"WEBHOOK_SHUTDOWN_POLICY"`
+	Timeout              string `json:"timeout"              env:"REGISTRATION_TIMEOUT"`
+	MaxInterval          string `json:"maxInterval"          env:"REGISTRATION_MAX_INTERVAL"`
+	LeaseName            string `json:"leaseName"            env:"LEASE_NAME"`
+}
+
+// CertificateConfig configures the serving certificates
+type CertificateConfig struct {
+	Mode         string `json:"mode"         env:"CERT_MODE"`
+	Dir          string `json:"dir"          env:"TLS_CERT_DIR"`
+	KeyAlgorithm string `json:"keyAlgorithm" env:"CERT_KEY_ALGORITHM"`
+	Validity     string `json:"validity"     env:"CERT_VALIDITY"`
+	CAValidity   string `json:"caValidity"   env:"CA_VALIDITY"`
+	ExtraSANs    string `json:"extraSANs"    env:"CERT_EXTRA_SANS"`
+	CASecretName string `json:"caSecretName" env:"CA_SECRET_NAME"`
+}
+
+// TLSSettings configures the TLS server
+type TLSSettings struct {
+	ClientCAFile string `json:"clientCAFile" env:"CLIENT_CA_FILE"`
+	MinVersion   string `json:"minVersion"   env:"TLS_MIN_VERSION"`
+	CipherSuites string `json:"cipherSuites" env:"TLS_CIPHER_SUITES"`
+}
+
+// TracingConfig configures the OpenTelemetry spans of the admissions, the
+// exporter also reads the other OTEL_EXPORTER_OTLP envs, e.g. the headers
+type TracingConfig struct {
+	Endpoint      string `json:"endpoint"      env:"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"`
+	SamplingRatio string `json:"samplingRatio" env:"TRACING_SAMPLING_RATIO"`
+}
+
+// activeConfig is swapped as a whole on reload, so that a reader never sees
+// a half applied config
+var activeConfig atomic.Pointer[Config]
+
+func init() {
+	activeConfig.Store(DefaultConfig())
+}
+
+func currentConfig() *Config {
+	return activeConfig.Load()
+}
+
+// DefaultConfig returns the settings used when nothing overrides them
+//
+//nolint:exhaustruct
+func DefaultConfig() *Config {
+	return &Config{
+		Log: LogConfig{Level: "DEBUG"},
+		Injection: InjectionConfig{
+			Repo:            defaultRepo,
+			Tag:             defaultTag,
+			Sidecar:         defaultSidecar,
+			ImagePullPolicy: string(corev1.PullIfNotPresent),
+			LogLevel:        defaultLogLvl,
+		},
+		Registration: RegistrationConfig{LeaseName: defaultLeaseName},
+		Certificates: CertificateConfig{CASecretName: defaultCASecretName},
+		Tracing:      TracingConfig{SamplingRatio: defaultSamplingRatio},
+	}
+}
+
+// RegisterConfigFlags defines a string flag for every setting, named after
+// its env: REPO is -repo, IMAGE_PULL_POLICY is -image-pull-policy
+func RegisterConfigFlags(fs *flag.FlagSet) {
+	_ = walkConfig(DefaultConfig(), func(env string, _ reflect.Value) error {
+		fs.String(flagName(env), "", fmt.Sprintf("overrides the %v env", env))
+		return nil
+	})
+}
+
+// LoadConfig reads the YAML file at path, when set, over the defaults, then
+// applies the non-empty envs and the flags set in fs, and validates the result
+func LoadConfig(path string, fs *flag.FlagSet) (*Config, error) {
+	config := DefaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err = yaml.UnmarshalStrict(data, config); err != nil {
+			return nil, fmt.Errorf("invalid config file %v: %w", path, err)
+		}
+		config.checksum = sha256.Sum256(data)
+	}
+
+	set := make(map[string]string)
+	if fs != nil {
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = f.Value.String() })
+	}
+	err := walkConfig(config, func(env string, v reflect.Value) error {
+		value, ok := set[flagName(env)]
+		if !ok {
+			value = os.Getenv(env)
+		}
+		if value == "" {
+			return nil
+		}
+		switch v.Kind() { //nolint:exhaustive
+		case reflect.String:
+			v.SetString(value)
+		case reflect.Slice:
+			var items []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			v.Set(reflect.ValueOf(items))
+		default:
+			return fmt.Errorf("unsupported type %v of %v", v.Type(), env)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// walkConfig calls fn with every setting and its env name
+func walkConfig(config *Config, fn func(env string, v reflect.Value) error) error {
+	var walk func(v reflect.Value) error
+	walk = func(v reflect.Value) error {
+		for i := range v.NumField() {
+			field, value := v.Type().Field(i), v.Field(i)
+			if value.Kind() == reflect.Struct {
+				if err := walk(value); err != nil {
+					return err
+				}
+				continue
+			}
+			if env := field.Tag.Get("env"); env != "" {
+				if err := fn(env, value); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return walk(reflect.ValueOf(config).Elem())
+}
+
+func flagName(env string) string {
+	return strings.ReplaceAll(strings.ToLower(env), "_", "-")
+}
+
+// Validate checks the settings that are not checked when the webhook
+// initializes, the others are validated by Init
+func (c *Config) Validate() error {
+	var errs []error
+
+	if _, err := logLevel(c.Log.Level); err != nil {
+		errs = append(errs, err)
+	}
+	switch c.Log.Type {
+	case "", "JSON", "TEXT":
+	default:
+		errs = append(errs, fmt.Errorf("invalid log type %v, expect JSON or TEXT", c.Log.Type))
+	}
+
+	in := c.Injection
+	switch corev1.PullPolicy(in.ImagePullPolicy) {
+	case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+	default:
+		errs = append(errs, fmt.Errorf("invalid image pull policy %v, expect one of %v, %v, %v",
+			in.ImagePullPolicy, corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever))
+	}
+	for _, v := range []struct{ name, value string }{
+		{name: "repo", value: in.Repo},
+		{name: "tag", value: in.Tag},
+		{name: "sidecar", value: in.Sidecar},
+	} {
+		if v.value == "" {
+			errs = append(errs, fmt.Errorf("the stub %v must not be empty", v.name))
+		}
+	}
+	if errs1123 := validation.IsDNS1123Label(in.Sidecar); in.Sidecar != "" && len(errs1123) > 0 {
+		errs = append(errs, fmt.Errorf("invalid sidecar name %q: %v", in.Sidecar, strings.Join(errs1123, ", ")))
+	}
+	for _, name := range strings.Split(in.Warnings, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" && name != noWarnings && !isWarningName(name) {
+			errs = append(errs, fmt.Errorf("unknown warning %v", name))
+		}
+	}
+	if e := validation.IsDNS1123Subdomain(in.NamespaceConfigMap); in.NamespaceConfigMap != "" && len(e) > 0 {
+		errs = append(errs, fmt.Errorf("invalid namespace ConfigMap name %q: %v",
+			in.NamespaceConfigMap, strings.Join(e, ", ")))
+	}
+	for _, ns := range in.IgnoredNamespaces {
+		if e := validation.IsDNS1123Label(ns); len(e) > 0 {
+			errs = append(errs, fmt.Errorf("invalid ignored namespace %q: %v", ns, strings.Join(e, ", ")))
+		}
+	}
+
+	if c.Tracing.Endpoint != "" {
+		if err := parseTracesEndpoint(c.Tracing.Endpoint); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if _, err := parseSamplingRatio(c.Tracing.SamplingRatio); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+func isWarningName(name string) bool {
+	for _, c := range warningChecks {
+		if c.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SetConfig makes config the active config, and exposes its startup
+// settings to Init
+func SetConfig(config *Config) {
+	r, certs, tls := config.Registration, config.Certificates, config.TLS
+	MsmWHConfigName = r.MutatingConfigName
+	MsmValidatingWHConfigName = r.ValidatingConfigName
+	MutatingWebhookConfigs = r.MutatingConfigs
+	ValidatingWebhookConfigs = r.ValidatingConfigs
+	MutatingWebhookSelector = r.MutatingSelector
+	ValidatingWebhookSelector = r.ValidatingSelector
+	ServiceName = r.ServiceName
+	WebhookRegistration = r.Mode
+	WebhookFailurePolicy = r.FailurePolicy
+	WebhookTimeoutSeconds = r.TimeoutSeconds
+	WebhookSideEffects = r.SideEffects
+	WebhookReinvocationPolicy = r.ReinvocationPolicy
+	WebhookNamespaceSelector = r.NamespaceSelector
+	WebhookObjectSelector = r.ObjectSelector
+	WebhookShutdownPolicy = r.ShutdownPolicy
+	RegistrationTimeout = r.Timeout
+	RegistrationMaxInterval = r.MaxInterval
+	LeaseName = r.LeaseName
+	CertMode = certs.Mode
+	CertDir = certs.Dir
+	CertKeyAlgorithm = certs.KeyAlgorithm
+	CertValidity = certs.Validity
+	CAValidity = certs.CAValidity
+	CertExtraSANs = certs.ExtraSANs
+	CASecretName = certs.CASecretName
+	ClientCAFile = tls.ClientCAFile
+	TLSMinVersion = tls.MinVersion
+	TLSCipherSuites = tls.CipherSuites
+
+	activeConfig.Store(config)
+}
+
+// ConfigureLogger applies the log settings to l
+func ConfigureLogger(l *logrus.Logger, c LogConfig) {
+	level, err := logLevel(c.Level)
+	if err != nil {
+		level = logrus.DebugLevel
+	}
+	l.SetLevel(level)
+
+	switch c.Type {
+	case "JSON":
+		l.SetFormatter(&logrus.JSONFormatter{ //nolint:exhaustruct
+			PrettyPrint: true,
+		})
+	default:
+		l.SetFormatter(&logrus.TextFormatter{ //nolint:exhaustruct
+			ForceColors:     true,
+			DisableColors:   false,
+			FullTimestamp:   true,
+			TimestampFormat: "2006-01-02 15:04:05",
+		})
+	}
+}
+
+func logLevel(level string) (logrus.Level, error) {
+	switch level {
+	case "", "DEBUG":
+		return logrus.DebugLevel, nil
+	case "TRACE":
+		return logrus.TraceLevel, nil
+	case "INFO":
+		return logrus.InfoLevel, nil
+	case "WARN":
+		return logrus.WarnLevel, nil
+	case "ERROR":
+		return logrus.ErrorLevel, nil
+	case "FATAL":
+		return logrus.FatalLevel, nil
+	default:
+		return logrus.DebugLevel, fmt.Errorf("invalid log level %v, expect one of TRACE, DEBUG, INFO, WARN, ERROR, FATAL", level)
+	}
+}
+
+// WatchConfig reloads the config file whenever it changes. An invalid file
+// keeps the active config, and changed startup settings only apply after a
+// restart.
+func (w *MsmWebhook) WatchConfig(ctx context.Context, path string, fs *flag.FlagSet) {
+	if path == "" {
+		return
+	}
+	// the file may have changed since it was loaded at startup
+	sum := currentConfig().checksum
+
+	ticker := time.NewTicker(configReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		sum = w.reloadConfig(path, fs, sum)
+	}
+}
+
+// reloadConfig loads the config file when its checksum differs from sum, and
+// returns the checksum of the content it handled
+func (w *MsmWebhook) reloadConfig(path string, fs *flag.FlagSet, sum [sha256.Size]byte) [sha256.Size]byte {
+	// a mounted ConfigMap is swapped through a symlink, reading the
+	// content rather than the modification time catches that
+	next, err := configChecksum(path)
+	if err != nil || next == sum {
+		return sum
+	}
+
+	config, err := LoadConfig(path, fs)
+	if err != nil {
+		w.Log.Errorf("Keeping the active config, could not reload %v: %v", path, err)
+		return next
+	}
+	active := currentConfig()
+	if !reflect.DeepEqual(config.Registration, active.Registration) ||
+		!reflect.DeepEqual(config.Certificates, active.Certificates) ||
+		!reflect.DeepEqual(config.TLS, active.TLS) ||
+		config.Tracing != active.Tracing {
+		w.Log.Warnf("Registration, certificate, TLS and tracing settings of %v only apply after a restart", path)
+		config.Registration, config.Certificates, config.TLS = active.Registration, active.Certificates, active.TLS
+		config.Tracing = active.Tracing
+	}
+	if config.Injection.NamespaceConfigMap != active.Injection.NamespaceConfigMap {
+		w.Log.Warnf("The namespace ConfigMap name of %v only applies after a restart", path)
+		config.Injection.NamespaceConfigMap = active.Injection.NamespaceConfigMap
+	}
+	activeConfig.Store(config)
+	ConfigureLogger(w.Log, config.Log)
+	w.Log.Infof("Reloaded config from %v", path)
+	return config.checksum
+}
+
+func configChecksum(path string) ([sha256.Size]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(data), nil
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigOverrides(t *testing.T) {
+	path := writeConfig(t, `
+injection:
+  repo: registry.example.com
+  tag: "1.0"
+  imagePullPolicy: Always
+  ignoredNamespaces: [monitoring]
+registration:
+  mutatingConfigName: msm-webhook
+`)
+	t.Setenv("TAG", "1.1")
+	t.Setenv("IMAGE_PULL_POLICY", "Never")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	RegisterConfigFlags(fs)
+	if err := fs.Parse([]string{"-tag", "1.2", "-ignored-namespace", "logging, tracing"}); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(path, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := config.Injection
+	if in.Repo != "registry.example.com" {
+		t.Errorf("repo = %v, want the file value", in.Repo)
+	}
+	if in.ImagePullPolicy != "Never" {
+		t.Errorf("imagePullPolicy = %v, want the env value", in.ImagePullPolicy)
+	}
+	if in.Tag != "1.2" {
+		t.Errorf("tag = %v, want the flag value", in.Tag)
+	}
+	if strings.Join(in.IgnoredNamespaces, ",") != "logging,tracing" {
+		t.Errorf("ignoredNamespaces = %v, want the flag value", in.IgnoredNamespaces)
+	}
+	if in.Sidecar != defaultSidecar {
+		t.Errorf("sidecar = %v, want the default", in.Sidecar)
+	}
+	if config.Registration.MutatingConfigName != "msm-webhook" {
+		t.Errorf("mutatingConfigName = %v, want the file value", config.Registration.MutatingConfigName)
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{name: "pull policy", content: "injection:\n  imagePullPolicy: Sometimes\n", want: "invalid image pull policy"},
+		{name: "unknown field", content: "injection:\n  registry: example.com\n", want: "unknown field"},
+		{name: "log level", content: "log:\n  level: VERBOSE\n", want: "invalid log level"},
+		{name: "warning", content: "injection:\n  warnings: latest-image,typo\n", want: "unknown warning typo"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, tc.content), nil)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("LoadConfig() error = %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	previous := currentConfig()
+	t.Cleanup(func() { activeConfig.Store(previous) })
+
+	path := writeConfig(t, `
+injection:
+  tag: "1.0"
+registration:
+  mutatingConfigName: msm-webhook
+`)
+	config, err := LoadConfig(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeConfig.Store(config)
+	w := newTestWebhook()
+
+	if sum := w.reloadConfig(path, nil, currentConfig().checksum); sum != config.checksum || currentConfig() != config {
+		t.Fatal("expected the file loaded at startup not to be reloaded")
+	}
+
+	// a change made before the watcher starts is still picked up
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`
+injection:
+  tag: "1.1"
+registration:
+  mutatingConfigName: other-webhook
+`)
+	sum := w.reloadConfig(path, nil, currentConfig().checksum)
+	if got := currentConfig().Injection.Tag; got != "1.1" {
+		t.Errorf("tag = %v, want the reloaded value", got)
+	}
+	if got := currentConfig().Registration.MutatingConfigName; got != "msm-webhook" {
+		t.Errorf("mutatingConfigName = %v, want the startup value", got)
+	}
+
+	write(`
+injection:
+  tag: "1.2"
+  unknownField: true
+`)
+	reloaded := currentConfig()
+	sum = w.reloadConfig(path, nil, sum)
+	if currentConfig() != reloaded {
+		t.Error("expected an invalid file to keep the active config")
+	}
+	if next := w.reloadConfig(path, nil, sum); next != sum {
+		t.Error("expected an invalid file to be handled once")
+	}
+}
@@ -23,7 +23,10 @@ const (
 	couldNotEncodeReview = "could not encode response: %v"
 	couldNotWriteReview  = "could not write response: %v"
 	invalidContentType   = "invalid Content-Type=%v, expect \"application/json\""
+	invalidMethod        = "invalid method %v, expect POST"
+	bodyTooLarge         = "request body exceeds %v bytes"
 	emptyBody            = "empty body"
+	emptyRequest         = "admission review has no request"
 	unsupportedKind      = "kind %v is not supported"
 
 	// msm-config values
@@ -31,29 +34,80 @@ const (
 	defaultRepo    = "ciscolabs"
 	defaultTag     = "latest"
 	defaultSidecar = "msm-rtsp-stub"
-	pullPolicyEnv  = "IMAGE_PULL_POLICY"
-	repoEnv        = "REPO"
-	tagEnv         = "TAG"
-	sidecarEnv     = "MSM_SIDECAR"
 	msmLogLvlEnv   = "MSM_LOG_LVL"
 	defaultLogLvl  = "WARN"
 	msmCpEnv       = "MSM_CONTROL_PLANE"
 	msmDpEnv       = "MSM_DATA_PLANE"
+	rtspSourcesEnv = "MSM_RTSP_SOURCES"
+	rtspUserEnv    = "MSM_RTSP_USERNAME"
+	rtspPassEnv    = "MSM_RTSP_PASSWORD"
+
+	defaultCASecretName = "msm-admission-webhook-ca"
+	defaultLeaseName    = "msm-admission-webhook-leader"
 
 	// msm-specific values
-	msmLabelKey    = "sidecar.mediastreamingmesh.io/inject"
-	msmServiceName = "msm-admission-webhook-svc"
+	msmLabelKey       = "sidecar.mediastreamingmesh.io/inject"
+	msmRTSPSourcesKey = "sidecar.mediastreamingmesh.io/rtsp-sources"
+	msmRTSPSecretKey  = "sidecar.mediastreamingmesh.io/rtsp-credentials-secret"
+	msmPortPlanKey    = "sidecar.mediastreamingmesh.io/port-plan"
+	msmServiceName    = "msm-admission-webhook-svc"
+	stubUID           = 1337
+	rtspPortName      = "rtsp"
+	rtpPortName       = "rtp"
+	rtcpPortName      = "rtcp"
+	defaultRTSPPort   = 8554
+	defaultRTPPort    = 8050
+	defaultRTCPPort   = 8051
+	rtspScheme        = "rtsp"
+	rtspsScheme       = "rtsps"
+	rtspSecretUserKey = "username"
+	rtspSecretPassKey = "password"
+
+	// admission warnings
+	latestTag                   = "latest"
+	latestImageWarning          = "latest-image"
+	missingLimitsWarning        = "missing-limits"
+	hostNetworkWarning          = "host-network"
+	deprecatedAnnotationWarning = "deprecated-annotation"
+	autoInjectionWarning        = "auto-injection"
+	noWarnings                  = "none"
+
+	// audit annotations, keys and values are part of the public interface
+	auditDecisionKey      = "decision"
+	auditRuleKey          = "rule"
+	auditStubImageKey     = "stub-image"
+	auditSidecarHashKey   = "sidecar-hash"
+	decisionInjected      = "injected"
+	decisionSkipped       = "skipped"
+	decisionDenied        = "denied"
+	decisionAllowed       = "allowed"
+	ruleUnsupportedKind   = "unsupported-kind"
+	ruleInvalidObject     = "invalid-object"
+	ruleIgnoredNamespace  = "ignored-namespace"
+	ruleNoLabel           = "no-label"
+	ruleInvalidAnnotation = "invalid-annotation"
+	ruleStubPresent       = "stub-present"
+	ruleInjectLabel       = "inject-label"
+	ruleMeshInvariants    = "mesh-invariants"
+	ruleStubConfig        = "stub-config"
+	ruleHostNetwork       = "host-network"
+	ruleStubUID           = "stub-uid"
+	ruleDelete            = "delete"
+	rulePatchVerification = "patch-verification"
+	rulePatchRendering    = "patch-rendering"
+	ruleUnmeshedWorkload  = "unmeshed-workload"
 
 	// k8s-specific values
-	deployment                = "Deployment"
-	pod                       = "Pod"
-	daemonSet                 = "DaemonSet"
-	statefulSet               = "StatefulSet"
-	mutateMethod              = "/mutate"
-	deploymentSubPath         = "/spec/template"
-	containersPath            = "/spec/containers"
-	admissionReviewKind       = "AdmissionReview"
-	admissionReviewAPIVersion = "admission.k8s.io/v1"
+	deployment          = "Deployment"
+	pod                 = "Pod"
+	daemonSet           = "DaemonSet"
+	statefulSet         = "StatefulSet"
+	mutateHandler       = "mutate"
+	validateHandler     = "validate"
+	mutateMethod        = "/mutate"
+	validateMethod      = "/validate"
+	admissionReviewKind = "AdmissionReview"
+	jsonContentType     = "application/json"
 
 	// Downward API Injection values
 	podName      = "MSM_POD_NAME"
@@ -68,7 +122,114 @@ const (
 	saPath       = "spec.serviceAccountName"
 
 	// TLS config values
-	readerTimeout = 120 * time.Second
+	tlsCertFile          = "tls.crt"
+	tlsKeyFile           = "tls.key"
+	caCertFile           = "ca.crt"
+	configReloadInterval = 10 * time.Second
+	certReloadInterval   = 10 * time.Second
+
+	// server timeouts
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = 30 * time.Second
+	writeTimeout      = 30 * time.Second
+	idleTimeout       = 120 * time.Second
+
+	// certificate modes
+	certModeSelfSigned          = "self-signed"
+	certModeFile                = "file"
+	certModeCertManager         = "cert-manager"
+	certManagerInjectAnnotation = "cert-manager.io/inject-ca-from"
+
+	// shared self-signed certificate
+	leaseDuration       = 15 * time.Second
+	leaseRenewDeadline  = 10 * time.Second
+	leaseRetryPeriod    = 2 * time.Second
+	caCheckInterval     = time.Minute
+	caRotationGrace     = 10 * time.Minute
+	caValidity          = 10 * 365 * 24 * time.Hour
+	servingValidity     = 7 * 24 * time.Hour
+	minServingValidity  = time.Hour
+	keyAlgorithmRSA     = "rsa"
+	keyAlgorithmECDSA   = "ecdsa-p256"
+	keyAlgorithmEd25519 = "ed25519"
+	certRetryInterval   = 30 * time.Second
+	clockSkew           = 5 * time.Minute
+	caKeyFile           = "ca.key"
+	caBundleFile        = "ca-bundle.crt"
+	nextCACertFile      = "next-ca.crt"
+	nextCAKeyFile       = "next-ca.key"
+
+	caChangedAtAnnotation = "mediastreamingmesh.io/ca-changed-at"
+
+	registrationPatch     = "patch"
+	registrationApply     = "apply"
+	fieldManager          = "msm-admission-webhook"
+	webhookNameSuffix     = "mediastreamingmesh.io"
+	defaultTimeoutSeconds = 10
+	eventReasonDrift      = "WebhookConfigDrift"
+	shutdownPolicyNone    = "none"
+	shutdownPolicyIgnore  = "ignore"
+	shutdownPolicyDelete  = "delete"
+	shutdownTimeout       = 10 * time.Second
+
+	failurePoliciesAnnotation = "mediastreamingmesh.io/failure-policies-before-shutdown"
+
+	eventReasonInvalidSettings = "InvalidInjectionSettings"
+	namespaceSettingsSyncWait  = 30 * time.Second
+	nsControlPlaneKey          = "controlPlane"
+	nsDataPlaneKey             = "dataPlane"
+	nsLogLevelKey              = "logLevel"
+	nsProfileKey               = "profile"
+	nsResourcesKey             = "resources"
+	profileSmall               = "small"
+	profileMedium              = "medium"
+	profileLarge               = "large"
+
+	tracerName              = "media-streaming-mesh/msm-admission-webhook"
+	tracingExportTimeout    = 5 * time.Second
+	tracingErrorLogInterval = time.Minute
+	defaultSamplingRatio    = "1"
+
+	registrationTimeout       = 2 * time.Minute
+	registrationCheckInterval = 30 * time.Second
+	handlerProbeTimeout       = 5 * time.Second
+	// longer than the API server ever waits for a webhook
+	handlerStuckTimeout     = 2 * writeTimeout
+	registrationMaxInterval = 30 * time.Second
+
+	// the API server caps requests at 3MiB, leave room for object and oldObject
+	maxRequestBodySize = 7 << 20
 )
 
-var MsmWHConfigName = ""
+var stubPortNames = []string{rtspPortName, rtpPortName, rtcpPortName}
+
+var (
+	MsmWHConfigName           = ""
+	MsmValidatingWHConfigName = ""
+	MutatingWebhookConfigs    = ""
+	ValidatingWebhookConfigs  = ""
+	MutatingWebhookSelector   = ""
+	ValidatingWebhookSelector = ""
+	CertDir                   = ""
+	CertMode                  = ""
+	CertKeyAlgorithm          = ""
+	CertValidity              = ""
+	CAValidity                = ""
+	ServiceName               = ""
+	CertExtraSANs             = ""
+	ClientCAFile              = ""
+	TLSMinVersion             = ""
+	TLSCipherSuites           = ""
+	WebhookRegistration       = ""
+	WebhookFailurePolicy      = ""
+	WebhookTimeoutSeconds     = ""
+	WebhookSideEffects        = ""
+	WebhookReinvocationPolicy = ""
+	WebhookNamespaceSelector  = ""
+	WebhookObjectSelector     = ""
+	WebhookShutdownPolicy     = ""
+	RegistrationTimeout       = ""
+	RegistrationMaxInterval   = ""
+	CASecretName              = defaultCASecretName
+	LeaseName                 = defaultLeaseName
+)
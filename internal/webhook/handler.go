@@ -21,95 +21,207 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"strings"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	v1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 )
 
+var errUnsupportedVersion = errors.New("unsupported AdmissionReview version")
+
 // handle is the http handler for msm webhook admission requests
 func (w *MsmWebhook) handle(rw http.ResponseWriter, r *http.Request) {
-	body, err := w.readRequest(r)
-	if err != nil {
-		http.Error(rw, err.Error(), http.StatusBadRequest)
+	defer w.health.track()()
+	start := time.Now()
+	// one snapshot per admission, a reload never mixes two configurations
+	config := currentConfig()
+
+	// continue the trace of the API server when it sends one
+	ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := startSpan(ctx, r.URL.Path, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("http.request.method", r.Method)))
+	defer span.End()
+	httpError := func(msg string, status int) {
+		span.SetStatus(codes.Error, msg)
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		http.Error(rw, msg, status)
 	}
 
-	msmAdmissionWebhookReview := v1.AdmissionReview{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       "",
-			APIVersion: "",
-		},
-		Request:  nil,
-		Response: nil,
+	body, status, err := w.readRequest(rw, r)
+	if err != nil {
+		httpError(err.Error(), status)
+		return
 	}
-	requestReview, err := w.parseAdmissionReview(body)
+
+	_, decodeSpan := startSpan(ctx, "decode")
+	requestReview, gvk, err := w.parseAdmissionReview(body)
 	if err != nil {
-		msmAdmissionWebhookReview.Response = &v1.AdmissionResponse{
-			UID:     "",
-			Allowed: false,
-			Result: &metav1.Status{
-				TypeMeta: metav1.TypeMeta{
-					Kind:       "",
-					APIVersion: "",
-				},
-				ListMeta: metav1.ListMeta{
-					ResourceVersion:    "",
-					Continue:           "",
-					RemainingItemCount: nil,
-				},
-				Status:  "",
-				Message: err.Error(),
-				Reason:  "",
-				Details: nil,
-				Code:    0,
-			},
-			Patch:            nil,
-			PatchType:        nil,
-			AuditAnnotations: nil,
-			Warnings:         nil,
-		}
-	} else if r.URL.Path == mutateMethod {
-		msmAdmissionWebhookReview.Response = w.mutate(requestReview.Request)
+		decodeSpan.RecordError(err)
+		decodeSpan.SetStatus(codes.Error, err.Error())
+	}
+	decodeSpan.End()
+	if err != nil && !errors.Is(err, errUnsupportedVersion) {
+		w.Log.Errorf("Can't decode admission review: %v", err)
+		httpError(err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var response *v1.AdmissionResponse
+	switch {
+	case err != nil:
+		// answer with an error review so the API server reports the reason
+		w.Log.Errorf("Can't decode admission review: %v", err)
+		response = errorReviewResponse(err)
+		response.UID = requestUID(body)
+	case requestReview.Request == nil:
+		w.Log.Error(emptyRequest)
+		httpError(emptyRequest, http.StatusBadRequest)
+		return
+	case r.URL.Path == mutateMethod:
+		span.SetAttributes(requestAttributes(requestReview.Request)...)
+		response = w.mutate(ctx, config, requestReview.Request)
+		response.UID = requestReview.Request.UID
+		observeDuration(ctx, mutateHandler, start)
+	case r.URL.Path == validateMethod:
+		span.SetAttributes(requestAttributes(requestReview.Request)...)
+		response = w.validate(ctx, config, requestReview.Request)
+		response.UID = requestReview.Request.UID
+		observeDuration(ctx, validateHandler, start)
+	default:
+		span.SetAttributes(attribute.Int("http.response.status_code", http.StatusNotFound))
+		http.NotFound(rw, r)
+		return
 	}
-	msmAdmissionWebhookReview.Response.UID = requestReview.Request.UID
-	msmAdmissionWebhookReview.Kind = admissionReviewKind
-	msmAdmissionWebhookReview.APIVersion = admissionReviewAPIVersion
 
-	resp, err := json.Marshal(msmAdmissionWebhookReview)
+	resp, err := encodeAdmissionReview(response, gvk)
 	if err != nil {
 		w.Log.Errorf("Can't encode response: %v", err)
-		http.Error(rw, fmt.Sprintf(couldNotEncodeReview, err), http.StatusInternalServerError)
+		httpError(fmt.Sprintf(couldNotEncodeReview, err), http.StatusInternalServerError)
+		return
 	}
 
+	rw.Header().Set("Content-Type", jsonContentType)
 	if _, err := rw.Write(resp); err != nil {
-		w.Log.Errorf("Can't write response: %v", err)
-		http.Error(rw, fmt.Sprintf(couldNotWriteReview, err), http.StatusInternalServerError)
+		// the status line is already sent, all that's left is to log
+		w.Log.Errorf(couldNotWriteReview, err)
+		span.RecordError(err)
 	}
 }
 
-// readRequest handles the intercepting request of the api server
-func (w *MsmWebhook) readRequest(r *http.Request) ([]byte, error) {
-	var body []byte
-	if r.Body != nil {
-		if data, err := io.ReadAll(r.Body); err == nil {
-			body = data
+// readRequest handles the intercepting request of the api server, on error
+// it returns the http status to answer with
+func (w *MsmWebhook) readRequest(rw http.ResponseWriter, r *http.Request) ([]byte, int, error) {
+	if r.Method != http.MethodPost {
+		msg := fmt.Sprintf(invalidMethod, r.Method)
+		w.Log.Error(msg)
+		return nil, http.StatusMethodNotAllowed, errors.New(msg)
+	}
+
+	if err := checkContentType(r.Header.Get("Content-Type")); err != nil {
+		w.Log.Error(err)
+		return nil, http.StatusUnsupportedMediaType, err
+	}
+
+	if r.Body == nil {
+		w.Log.Error(emptyBody)
+		return nil, http.StatusBadRequest, errors.New(emptyBody)
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(rw, r.Body, maxRequestBodySize))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			msg := fmt.Sprintf(bodyTooLarge, maxBytesErr.Limit)
+			w.Log.Error(msg)
+			return nil, http.StatusRequestEntityTooLarge, errors.New(msg)
 		}
+		w.Log.Errorf("Can't read request body: %v", err)
+		return nil, http.StatusBadRequest, err
 	}
 	if len(body) == 0 {
 		w.Log.Error(emptyBody)
-		return nil, errors.New(emptyBody)
+		return nil, http.StatusBadRequest, errors.New(emptyBody)
 	}
-	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/json" {
-		msg := fmt.Sprintf(invalidContentType, contentType)
-		w.Log.Error(msg)
-		return nil, errors.New(msg)
+
+	return body, http.StatusOK, nil
+}
+
+// checkContentType accepts application/json with an optional utf-8 charset
+func checkContentType(contentType string) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != jsonContentType {
+		return fmt.Errorf(invalidContentType, contentType)
+	}
+	for key, value := range params {
+		if key != "charset" || !strings.EqualFold(value, "utf-8") {
+			return fmt.Errorf(invalidContentType, contentType)
+		}
 	}
-	return body, nil
+	return nil
 }
 
-func (w *MsmWebhook) parseAdmissionReview(body []byte) (*v1.AdmissionReview, error) {
-	r := &v1.AdmissionReview{
+// parseAdmissionReview decodes an AdmissionReview of any supported version
+// into its v1 representation, along with the version the review was sent as
+func (w *MsmWebhook) parseAdmissionReview(body []byte) (*v1.AdmissionReview, schema.GroupVersionKind, error) {
+	gvk := v1.SchemeGroupVersion.WithKind(admissionReviewKind)
+
+	obj, decodedGVK, err := w.deserializer.Decode(body, nil, nil)
+	if err != nil {
+		if runtime.IsNotRegisteredError(err) {
+			return nil, gvk, fmt.Errorf("%w %v", errUnsupportedVersion, reviewAPIVersion(body))
+		}
+		return nil, gvk, err
+	}
+
+	switch review := obj.(type) {
+	case *v1.AdmissionReview:
+		return review, *decodedGVK, nil
+	case *v1beta1.AdmissionReview:
+		// both versions share the same wire format
+		r := &v1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{
+				Kind:       "",
+				APIVersion: "",
+			},
+			Request:  nil,
+			Response: nil,
+		}
+		if err := convertReview(review, r); err != nil {
+			return nil, gvk, err
+		}
+		return r, *decodedGVK, nil
+	default:
+		return nil, gvk, fmt.Errorf("%w %v", errUnsupportedVersion, decodedGVK.GroupVersion())
+	}
+}
+
+// encodeAdmissionReview wraps the response in an AdmissionReview of the
+// requested version
+func encodeAdmissionReview(response *v1.AdmissionResponse, gvk schema.GroupVersionKind) ([]byte, error) {
+	review := &v1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       admissionReviewKind,
+			APIVersion: gvk.GroupVersion().String(),
+		},
+		Request:  nil,
+		Response: response,
+	}
+
+	if gvk.GroupVersion() != v1beta1.SchemeGroupVersion {
+		return json.Marshal(review)
+	}
+
+	legacy := &v1beta1.AdmissionReview{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "",
 			APIVersion: "",
@@ -117,8 +229,37 @@ func (w *MsmWebhook) parseAdmissionReview(body []byte) (*v1.AdmissionReview, err
 		Request:  nil,
 		Response: nil,
 	}
-	if _, _, err := w.deserializer.Decode(body, nil, r); err != nil {
+	if err := convertReview(review, legacy); err != nil {
 		return nil, err
 	}
-	return r, nil
+	return json.Marshal(legacy)
+}
+
+func convertReview(in, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// requestUID extracts the request UID from a review that could not be decoded
+func requestUID(body []byte) types.UID {
+	var review struct {
+		Request *struct {
+			UID types.UID `json:"uid"`
+		} `json:"request"`
+	}
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		return ""
+	}
+	return review.Request.UID
+}
+
+func reviewAPIVersion(body []byte) string {
+	var meta metav1.TypeMeta
+	if err := json.Unmarshal(body, &meta); err != nil {
+		return ""
+	}
+	return meta.APIVersion
 }
@@ -0,0 +1,305 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+//nolint:exhaustruct
+func newTestWebhook() *MsmWebhook {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return &MsmWebhook{
+		Deps:         Deps{Log: logger},
+		deserializer: newDeserializer(),
+	}
+}
+
+//nolint:exhaustruct
+func testPod(tb testing.TB, labels map[string]string) runtime.RawExtension {
+	tb.Helper()
+	p := corev1.Pod{
+		TypeMeta: metav1.TypeMeta{Kind: pod, APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "camera",
+			Namespace: "media",
+			Labels:    labels,
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "app:1.0"}},
+		},
+	}
+	raw, err := json.Marshal(p)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return runtime.RawExtension{Raw: raw}
+}
+
+//nolint:exhaustruct
+func testRequest(tb testing.TB, labels map[string]string) v1.AdmissionRequest {
+	tb.Helper()
+	return v1.AdmissionRequest{
+		UID:       "0d2ac1b0-5f2c-4a0f-9d54-4a9c5a4e8a01",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: pod},
+		Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+		Namespace: "media",
+		Operation: v1.Create,
+		Object:    testPod(tb, labels),
+	}
+}
+
+func postReview(t *testing.T, w *MsmWebhook, path string, body []byte) []byte {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	w.handle(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %v: %v", rec.Code, rec.Body.String())
+	}
+	return rec.Body.Bytes()
+}
+
+//nolint:exhaustruct
+func TestHandleReviewVersions(t *testing.T) {
+	labelled := map[string]string{msmLabelKey: "true"}
+
+	tests := []struct {
+		name      string
+		labels    map[string]string
+		wantPatch bool
+	}{
+		{name: "unlabelled", labels: nil, wantPatch: false},
+		{name: "labelled", labels: labelled, wantPatch: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+"/v1", func(t *testing.T) {
+			w := newTestWebhook()
+			request := testRequest(t, tt.labels)
+			body, err := json.Marshal(v1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{Kind: admissionReviewKind, APIVersion: v1.SchemeGroupVersion.String()},
+				Request:  &request,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			obj, gvk, err := w.deserializer.Decode(postReview(t, w, mutateMethod, body), nil, nil)
+			if err != nil {
+				t.Fatalf("could not decode response: %v", err)
+			}
+			if gvk.GroupVersion() != v1.SchemeGroupVersion {
+				t.Fatalf("expected %v response, got %v", v1.SchemeGroupVersion, gvk.GroupVersion())
+			}
+			review, ok := obj.(*v1.AdmissionReview)
+			if !ok || review.Response == nil {
+				t.Fatalf("expected a v1 review with a response, got %#v", obj)
+			}
+			if review.Response.UID != request.UID {
+				t.Errorf("expected UID %v, got %v", request.UID, review.Response.UID)
+			}
+			if !review.Response.Allowed {
+				t.Errorf("expected request to be allowed: %v", review.Response.Result)
+			}
+			if (len(review.Response.Patch) > 0) != tt.wantPatch {
+				t.Errorf("expected patch=%v, got %s", tt.wantPatch, review.Response.Patch)
+			}
+		})
+
+		t.Run(tt.name+"/v1beta1", func(t *testing.T) {
+			w := newTestWebhook()
+			request := testRequest(t, tt.labels)
+			legacyRequest := v1beta1.AdmissionRequest{}
+			if err := convertReview(&request, &legacyRequest); err != nil {
+				t.Fatal(err)
+			}
+			body, err := json.Marshal(v1beta1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{Kind: admissionReviewKind, APIVersion: v1beta1.SchemeGroupVersion.String()},
+				Request:  &legacyRequest,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			obj, gvk, err := w.deserializer.Decode(postReview(t, w, mutateMethod, body), nil, nil)
+			if err != nil {
+				t.Fatalf("could not decode response: %v", err)
+			}
+			if gvk.GroupVersion() != v1beta1.SchemeGroupVersion {
+				t.Fatalf("expected %v response, got %v", v1beta1.SchemeGroupVersion, gvk.GroupVersion())
+			}
+			review, ok := obj.(*v1beta1.AdmissionReview)
+			if !ok || review.Response == nil {
+				t.Fatalf("expected a v1beta1 review with a response, got %#v", obj)
+			}
+			if review.Response.UID != request.UID {
+				t.Errorf("expected UID %v, got %v", request.UID, review.Response.UID)
+			}
+			if !review.Response.Allowed {
+				t.Errorf("expected request to be allowed: %v", review.Response.Result)
+			}
+			if (len(review.Response.Patch) > 0) != tt.wantPatch {
+				t.Errorf("expected patch=%v, got %s", tt.wantPatch, review.Response.Patch)
+			}
+			if tt.wantPatch && (review.Response.PatchType == nil || *review.Response.PatchType != v1beta1.PatchTypeJSONPatch) {
+				t.Errorf("expected JSONPatch patch type, got %v", review.Response.PatchType)
+			}
+		})
+	}
+}
+
+//nolint:exhaustruct
+func TestHandleUnknownReviewVersion(t *testing.T) {
+	w := newTestWebhook()
+	request := testRequest(t, map[string]string{msmLabelKey: "true"})
+	body, err := json.Marshal(v1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{Kind: admissionReviewKind, APIVersion: "admission.k8s.io/v2"},
+		Request:  &request,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj, gvk, err := w.deserializer.Decode(postReview(t, w, mutateMethod, body), nil, nil)
+	if err != nil {
+		t.Fatalf("could not decode response: %v", err)
+	}
+	if gvk.GroupVersion() != v1.SchemeGroupVersion {
+		t.Fatalf("expected %v response, got %v", v1.SchemeGroupVersion, gvk.GroupVersion())
+	}
+	review, ok := obj.(*v1.AdmissionReview)
+	if !ok || review.Response == nil {
+		t.Fatalf("expected a v1 review with a response, got %#v", obj)
+	}
+	if review.Response.Allowed {
+		t.Error("expected request with unknown version to be rejected")
+	}
+	if review.Response.UID != request.UID {
+		t.Errorf("expected UID %v, got %v", request.UID, review.Response.UID)
+	}
+	want := fmt.Sprintf("%v admission.k8s.io/v2", errUnsupportedVersion)
+	if review.Response.Result == nil || review.Response.Result.Message != want {
+		t.Errorf("expected result %q, got %v", want, review.Response.Result)
+	}
+}
+
+//nolint:exhaustruct
+func TestHandleStatusCodes(t *testing.T) {
+	request := testRequest(t, nil)
+	valid, err := json.Marshal(v1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{Kind: admissionReviewKind, APIVersion: v1.SchemeGroupVersion.String()},
+		Request:  &request,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	noRequest, err := json.Marshal(v1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{Kind: admissionReviewKind, APIVersion: v1.SchemeGroupVersion.String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        []byte
+		want        int
+	}{
+		{"valid", http.MethodPost, mutateMethod, "application/json", valid, http.StatusOK},
+		{"charset", http.MethodPost, mutateMethod, "application/json; charset=utf-8", valid, http.StatusOK},
+		{"charset case", http.MethodPost, mutateMethod, "Application/JSON; charset=UTF-8", valid, http.StatusOK},
+		{"unknown parameter", http.MethodPost, mutateMethod, "application/json; foo=bar", valid, http.StatusUnsupportedMediaType},
+		{"other charset", http.MethodPost, mutateMethod, "application/json; charset=latin1", valid, http.StatusUnsupportedMediaType},
+		{"wrong content type", http.MethodPost, mutateMethod, "text/plain", valid, http.StatusUnsupportedMediaType},
+		{"missing content type", http.MethodPost, mutateMethod, "", valid, http.StatusUnsupportedMediaType},
+		{"wrong method", http.MethodGet, mutateMethod, "application/json", valid, http.StatusMethodNotAllowed},
+		{"empty body", http.MethodPost, mutateMethod, "application/json", nil, http.StatusBadRequest},
+		{"malformed body", http.MethodPost, mutateMethod, "application/json", []byte("{"), http.StatusBadRequest},
+		{"no request", http.MethodPost, mutateMethod, "application/json", noRequest, http.StatusBadRequest},
+		{"too large", http.MethodPost, mutateMethod, "application/json",
+			bytes.Repeat([]byte(" "), maxRequestBodySize+1), http.StatusRequestEntityTooLarge},
+		{"unknown path", http.MethodPost, "/other", "application/json", valid, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTestWebhook()
+			req := httptest.NewRequest(tt.method, tt.path, bytes.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+			w.handle(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("expected status %v, got %v: %v", tt.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+//nolint:exhaustruct
+func FuzzHandle(f *testing.F) {
+	request := testRequest(f, map[string]string{msmLabelKey: "true"})
+	for _, version := range []string{v1.SchemeGroupVersion.String(), v1beta1.SchemeGroupVersion.String()} {
+		seed, err := json.Marshal(v1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{Kind: admissionReviewKind, APIVersion: version},
+			Request:  &request,
+		})
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(seed)
+	}
+	f.Add([]byte(`{"kind":"AdmissionReview","apiVersion":"admission.k8s.io/v1"}`))
+	f.Add([]byte(`{"kind":"AdmissionReview","apiVersion":"admission.k8s.io/v1","request":{"kind":{"kind":"Pod"}}}`))
+	f.Add([]byte(`{"kind":"AdmissionReview","apiVersion":"admission.k8s.io/v1","request":{"kind":{"kind":"Deployment"},"object":null}}`))
+	f.Add([]byte(`{"kind":"AdmissionReview","apiVersion":"admission.k8s.io/v1","request":{"kind":{"kind":"Pod"},"object":{"metadata":{"labels":{"sidecar.mediastreamingmesh.io/inject":"true"},"annotations":{"sidecar.mediastreamingmesh.io/port-plan":"rtsp="}}}}}`))
+	f.Add([]byte(`null`))
+	f.Add([]byte(`[]`))
+
+	w := newTestWebhook()
+	f.Fuzz(func(t *testing.T, body []byte) {
+		for _, path := range []string{mutateMethod, validateMethod} {
+			req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			w.handle(rec, req)
+			if rec.Code >= http.StatusInternalServerError {
+				t.Errorf("unexpected status %v: %v", rec.Code, rec.Body.String())
+			}
+		}
+	})
+}
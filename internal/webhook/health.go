@@ -0,0 +1,242 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var (
+	errNotServing       = errors.New("TLS listener is not serving")
+	errNotRegistered    = errors.New("webhook registration has not succeeded yet")
+	errProbeRunning     = errors.New("previous handler probe has not returned")
+	errHandlerTimeout   = errors.New("handler probe timed out")
+	errCABundleMismatch = errors.New("caBundle does not trust the served certificate")
+)
+
+// health tracks what the readiness and liveness probes report
+type health struct {
+	serving      atomic.Bool
+	registration atomic.Pointer[error]
+	probing      atomic.Bool
+
+	mu       sync.Mutex
+	next     uint64
+	inflight map[uint64]time.Time
+}
+
+// Ready reports whether the replica can take admission requests: the TLS
+// listener is serving an unexpired certificate that the managed webhook
+// configurations trust
+func (w *MsmWebhook) Ready() error {
+	if !w.health.serving.Load() {
+		return errNotServing
+	}
+	cert, err := w.getCertificate(nil)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf != nil && time.Now().After(cert.Leaf.NotAfter) {
+		return fmt.Errorf("certificate expired at %v", cert.Leaf.NotAfter)
+	}
+	if err := w.health.registration.Load(); err == nil {
+		return errNotRegistered
+	} else if *err != nil {
+		return *err
+	}
+	return nil
+}
+
+// Alive reports whether the admission handler still answers: no request is
+// stuck in it, and a dry run admission returns in time
+func (w *MsmWebhook) Alive() error {
+	if stuck := w.health.oldestInflight(); stuck > handlerStuckTimeout {
+		return fmt.Errorf("an admission request has been handled for %v", stuck.Round(time.Second))
+	}
+	return w.probeHandler()
+}
+
+// track records an admission request in flight until the returned func is called
+func (h *health) track() func() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.inflight == nil {
+		h.inflight = make(map[uint64]time.Time)
+	}
+	id := h.next
+	h.next++
+	h.inflight[id] = time.Now()
+
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.inflight, id)
+	}
+}
+
+func (h *health) oldestInflight() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var oldest time.Duration
+	for _, start := range h.inflight {
+		if d := time.Since(start); d > oldest {
+			oldest = d
+		}
+	}
+	return oldest
+}
+
+// probeKey marks the context of the liveness probe admissions
+type probeKey struct{}
+
+// isProbe reports an admission sent by the liveness probe, it is left out of
+// the metrics and the traces
+func isProbe(ctx context.Context) bool {
+	return ctx.Value(probeKey{}) != nil
+}
+
+// probeHandler sends a dry run admission review through the handler, dry
+// runs skip every side effect and the probe is neither counted nor traced
+func (w *MsmWebhook) probeHandler() error {
+	if !w.health.probing.CompareAndSwap(false, true) {
+		return errProbeRunning
+	}
+
+	body, err := livenessReview()
+	if err != nil {
+		w.health.probing.Store(false)
+		return err
+	}
+	done := make(chan int, 1)
+	go func() {
+		defer w.health.probing.Store(false)
+		r := httptest.NewRequest(http.MethodPost, validateMethod, strings.NewReader(string(body)))
+		r = r.WithContext(context.WithValue(r.Context(), probeKey{}, true))
+		r.Header.Set("Content-Type", jsonContentType)
+		rw := httptest.NewRecorder()
+		w.handle(rw, r)
+		done <- rw.Code
+	}()
+
+	select {
+	case code := <-done:
+		if code != http.StatusOK {
+			return fmt.Errorf("handler probe returned status %v", code)
+		}
+		return nil
+	case <-time.After(handlerProbeTimeout):
+		return errHandlerTimeout
+	}
+}
+
+//nolint:exhaustruct
+func livenessReview() ([]byte, error) {
+	dryRun := true
+	return json.Marshal(v1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{Kind: admissionReviewKind, APIVersion: v1.SchemeGroupVersion.String()},
+		Request: &v1.AdmissionRequest{
+			UID:       "livenessz",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: pod},
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Operation: v1.Create,
+			Object:    runtime.RawExtension{Raw: []byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"livenessz"}}`)},
+			DryRun:    &dryRun,
+		},
+	})
+}
+
+// watchRegistration periodically checks that every managed webhook
+// configuration trusts the served certificate
+func (w *MsmWebhook) watchRegistration(ctx context.Context) {
+	ticker := time.NewTicker(registrationCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		w.recordRegistration(w.checkRegistration(ctx))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// recordRegistration updates the readiness with the result of a registration
+// check. Once the registration succeeded, only a caBundle that definitely
+// does not trust the served certificate makes the replica unready, an API
+// error is transient and would otherwise take every replica out at once.
+func (w *MsmWebhook) recordRegistration(err error) {
+	prev := w.health.registration.Load()
+	if err != nil && !errors.Is(err, errCABundleMismatch) && prev != nil && *prev == nil {
+		w.Log.Warnf("Could not check the webhook registration, keeping it ready: %v", err)
+		return
+	}
+	w.health.registration.Store(&err)
+	if prev == nil || (*prev == nil) != (err == nil) {
+		if err != nil {
+			w.Log.Warnf("Webhook registration is not ready: %v", err)
+		} else {
+			w.Log.Info("Webhook registration is ready")
+		}
+	}
+}
+
+// checkRegistration checks that every managed webhook configuration trusts
+// the served certificate, a caBundle that does not is reported as
+// errCABundleMismatch
+func (w *MsmWebhook) checkRegistration(ctx context.Context) error {
+	cert, err := w.getCertificate(nil)
+	if err != nil {
+		return err
+	}
+	for _, kind := range w.managed.kinds() {
+		names, err := kind.resolve(ctx)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			config, err := kind.get(ctx, name)
+			if err != nil {
+				return fmt.Errorf("could not get %v %v: %w", kind.kind, name, err)
+			}
+			owned := w.owned(config)
+			if len(owned) == 0 {
+				return fmt.Errorf("%v %v: %w", kind.kind, name, errNoWebhookWithName)
+			}
+			for _, wh := range owned {
+				if err := verifyCABundle(wh.config.CABundle, cert); err != nil {
+					return fmt.Errorf("webhook %v in %v: %w: %w", wh.name, name, errCABundleMismatch, err)
+				}
+			}
+		}
+	}
+	return nil
+}
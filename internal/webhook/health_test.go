@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	admitv1 "k8s.io/api/admissionregistration/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestAlive(t *testing.T) {
+	w := newTestWebhook()
+	if err := w.Alive(); err != nil {
+		t.Fatalf("Alive() = %v, want nil", err)
+	}
+
+	done := w.health.track()
+	w.health.mu.Lock()
+	for id := range w.health.inflight {
+		w.health.inflight[id] = time.Now().Add(-2 * handlerStuckTimeout)
+	}
+	w.health.mu.Unlock()
+	if err := w.Alive(); err == nil {
+		t.Error("Alive() = nil with a stuck request")
+	}
+
+	done()
+	if err := w.Alive(); err != nil {
+		t.Errorf("Alive() = %v after the stuck request returned", err)
+	}
+}
+
+func TestReady(t *testing.T) {
+	w := newTestWebhook()
+	if err := w.Ready(); !errors.Is(err, errNotServing) {
+		t.Errorf("Ready() = %v, want %v", err, errNotServing)
+	}
+
+	w.health.serving.Store(true)
+	if err := w.Ready(); !errors.Is(err, errNoCertificate) {
+		t.Errorf("Ready() = %v, want %v", err, errNoCertificate)
+	}
+}
+
+//nolint:exhaustruct
+func TestReadyRegistration(t *testing.T) {
+	config := func(caBundle []byte) *admitv1.MutatingWebhookConfiguration {
+		return &admitv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "msm-webhook"},
+			Webhooks: []admitv1.MutatingWebhook{{
+				Name:         "msm-webhook.mediastreamingmesh.io",
+				ClientConfig: admitv1.WebhookClientConfig{Service: ownService(), CABundle: caBundle},
+			}},
+		}
+	}
+	w, clientset := newRegistrationTestWebhook()
+	w.certOpts = newCertTestOptions()
+	now := time.Now()
+	caPEM, keyPEM, err := w.newCA(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, key, _ := parseCA(caPEM, keyPEM)
+	cert, err := w.issueServingCert(ca, key, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.setCertificate(cert, caPEM)
+	w.health.serving.Store(true)
+	ctx := context.Background()
+	configs := clientset.AdmissionregistrationV1().MutatingWebhookConfigurations()
+
+	if err := w.Ready(); !errors.Is(err, errNotRegistered) {
+		t.Fatalf("Ready() = %v before any check, want %v", err, errNotRegistered)
+	}
+
+	// a transient error before the first success keeps the replica unready
+	w.recordRegistration(w.checkRegistration(ctx))
+	if err := w.Ready(); err == nil {
+		t.Fatal("Ready() = nil while the config does not exist")
+	}
+
+	if _, err := configs.Create(ctx, config(caPEM), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	w.recordRegistration(w.checkRegistration(ctx))
+	if err := w.Ready(); err != nil {
+		t.Fatalf("Ready() = %v with a trusting caBundle", err)
+	}
+
+	// once ready, an API error is not a reason to leave the Service
+	failing := true
+	clientset.PrependReactor("get", "mutatingwebhookconfigurations", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if failing {
+			return true, nil, apierrors.NewServiceUnavailable("etcd is down")
+		}
+		return false, nil, nil
+	})
+	w.recordRegistration(w.checkRegistration(ctx))
+	if err := w.Ready(); err != nil {
+		t.Fatalf("Ready() = %v after a transient API error", err)
+	}
+
+	// a caBundle that does not trust the certificate is
+	failing = false
+	otherPEM, _, err := w.newCA(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := configs.Update(ctx, config(otherPEM), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	w.recordRegistration(w.checkRegistration(ctx))
+	if err := w.Ready(); !errors.Is(err, errCABundleMismatch) {
+		t.Fatalf("Ready() = %v, want %v", err, errCABundleMismatch)
+	}
+}
+
+// blockingHook holds the log entries of the handler probe until released
+type blockingHook struct {
+	release chan struct{}
+}
+
+func (h *blockingHook) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (h *blockingHook) Fire(entry *logrus.Entry) error {
+	if strings.Contains(entry.Message, "livenessz") {
+		<-h.release
+	}
+	return nil
+}
+
+func TestAliveProbeTimeout(t *testing.T) {
+	w := newTestWebhook()
+	w.Log.SetLevel(logrus.DebugLevel)
+	hook := &blockingHook{release: make(chan struct{})}
+	w.Log.AddHook(hook)
+
+	if err := w.Alive(); !errors.Is(err, errHandlerTimeout) {
+		t.Fatalf("Alive() = %v with a hanging handler, want %v", err, errHandlerTimeout)
+	}
+	if err := w.Alive(); !errors.Is(err, errProbeRunning) {
+		t.Fatalf("Alive() = %v while the previous probe hangs, want %v", err, errProbeRunning)
+	}
+
+	close(hook.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for w.health.probing.Load() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := w.Alive(); err != nil {
+		t.Errorf("Alive() = %v once the handler returned", err)
+	}
+}
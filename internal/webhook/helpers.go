@@ -18,11 +18,14 @@ package webhook
 
 import (
 	"errors"
+	"fmt"
+	"net/http"
 	"net/url"
-	"os"
+	"strconv"
 	"strings"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 
 	v1 "k8s.io/api/admission/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -60,6 +63,33 @@ func errorReviewResponse(err error) *v1.AdmissionResponse {
 	}
 }
 
+func deniedReviewResponse(reasons []string) *v1.AdmissionResponse {
+	return &v1.AdmissionResponse{
+		UID:     "",
+		Allowed: false,
+		Result: &metav1.Status{
+			TypeMeta: metav1.TypeMeta{
+				Kind:       "",
+				APIVersion: "",
+			},
+			ListMeta: metav1.ListMeta{
+				ResourceVersion:    "",
+				Continue:           "",
+				RemainingItemCount: nil,
+			},
+			Status:  metav1.StatusFailure,
+			Message: fmt.Sprintf("denied by msm admission webhook: %v", strings.Join(reasons, "; ")),
+			Reason:  metav1.StatusReasonForbidden,
+			Details: nil,
+			Code:    http.StatusForbidden,
+		},
+		Patch:            nil,
+		PatchType:        nil,
+		AuditAnnotations: nil,
+		Warnings:         nil,
+	}
+}
+
 func okReviewResponse() *v1.AdmissionResponse {
 	return &v1.AdmissionResponse{
 		UID:              "",
@@ -121,80 +151,246 @@ func parseNSUrl(urlString string) (*NSUrl, error) {
 	return result, nil
 }
 
-func getPullPolicyValue() corev1.PullPolicy {
-	pullPolicy := os.Getenv(pullPolicyEnv)
-	if pullPolicy == "" {
-		return corev1.PullIfNotPresent
+func (w *MsmWebhook) rtspConfig(tuple *podSpecAndMeta) (*rtspConfig, error) {
+	result := &rtspConfig{
+		sources:    nil,
+		secretName: "",
 	}
+	annotations := tuple.meta.GetAnnotations()
 
-	return corev1.PullPolicy(pullPolicy)
-}
+	if value, ok := annotations[msmRTSPSourcesKey]; ok {
+		sources, err := parseRTSPSources(value)
+		if err != nil {
+			return nil, err
+		}
+		result.sources = sources
+	}
 
-func getRepo() string {
-	repo := os.Getenv(repoEnv)
-	if repo == "" {
-		return defaultRepo
+	if name, ok := annotations[msmRTSPSecretKey]; ok {
+		name = strings.TrimSpace(name)
+		if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid %v %q: %v", msmRTSPSecretKey, name, strings.Join(errs, ", "))
+		}
+		if len(result.sources) == 0 {
+			return nil, fmt.Errorf("%v is set but %v is empty", msmRTSPSecretKey, msmRTSPSourcesKey)
+		}
+		result.secretName = name
 	}
 
-	return repo
+	w.Log.Debugf("RTSP sources result: %v", result.sources)
+	return result, nil
 }
 
-func getSidecar() string {
-	sidecar := os.Getenv(sidecarEnv)
-	if sidecar == "" {
-		return defaultSidecar
+func parseRTSPSources(value string) ([]*RTSPSource, error) {
+	var result []*RTSPSource
+	for _, u := range strings.Split(value, ",") {
+		if strings.TrimSpace(u) == "" {
+			continue
+		}
+		source, err := parseRTSPUrl(u)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, source)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%v contains no RTSP source", msmRTSPSourcesKey)
+	}
+	return result, nil
+}
+
+func parseRTSPUrl(urlString string) (*RTSPSource, error) {
+	// Remove possible leading spaces from the source url
+	urlString = strings.Trim(urlString, " ")
+	newUrl, err := url.Parse(urlString)
+	if err != nil {
+		// the parse error would echo the url, which may contain credentials
+		return nil, errors.New("invalid RTSP source url")
+	}
+
+	if newUrl.User != nil {
+		return nil, fmt.Errorf("inline credentials are not allowed in RTSP source %v, reference a Secret via %v",
+			newUrl.Redacted(), msmRTSPSecretKey)
+	}
+
+	scheme := strings.ToLower(newUrl.Scheme)
+	if scheme != rtspScheme && scheme != rtspsScheme {
+		return nil, fmt.Errorf("invalid RTSP source %v: scheme must be %v or %v", newUrl, rtspScheme, rtspsScheme)
 	}
 
-	return sidecar
+	if newUrl.Hostname() == "" {
+		return nil, fmt.Errorf("invalid RTSP source %v: missing host", newUrl)
+	}
+
+	if port := newUrl.Port(); port != "" {
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return nil, fmt.Errorf("invalid RTSP source %v: invalid port", newUrl)
+		}
+	}
+
+	if newUrl.Fragment != "" {
+		return nil, fmt.Errorf("invalid RTSP source %v: fragments are not supported", newUrl)
+	}
+
+	return &RTSPSource{
+		Scheme: scheme,
+		Host:   newUrl.Host,
+		Path:   newUrl.Path,
+		Params: newUrl.Query(),
+	}, nil
 }
 
-func getTag() string {
-	tag := os.Getenv(tagEnv)
-	if tag == "" {
-		return defaultTag
+// String returns the source url without credentials
+func (s *RTSPSource) String() string {
+	u := url.URL{
+		Scheme:   s.Scheme,
+		Host:     s.Host,
+		Path:     s.Path,
+		RawQuery: s.Params.Encode(),
 	}
+	return u.String()
+}
 
-	return tag
+// portPlan returns the stub ports, either the defaults or the ones set in the
+// port plan annotation
+func portPlan(tuple *podSpecAndMeta) (map[string]int32, error) {
+	value, ok := tuple.meta.GetAnnotations()[msmPortPlanKey]
+	if !ok {
+		return map[string]int32{
+			rtspPortName: defaultRTSPPort,
+			rtpPortName:  defaultRTPPort,
+			rtcpPortName: defaultRTCPPort,
+		}, nil
+	}
+	return parsePortPlan(value)
 }
 
-func getMsmLogLvl() string {
-	logLvl := os.Getenv(msmLogLvlEnv)
-	if logLvl == "" {
-		return defaultLogLvl
+func parsePortPlan(value string) (map[string]int32, error) {
+	result := make(map[string]int32)
+	used := make(map[int32]string)
+	for _, entry := range strings.Split(value, ",") {
+		name, port, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found {
+			return nil, fmt.Errorf("invalid %v entry %q, expect name=port", msmPortPlanKey, entry)
+		}
+		if name != rtspPortName && name != rtpPortName && name != rtcpPortName {
+			return nil, fmt.Errorf("invalid %v entry %q, name must be one of %v, %v, %v",
+				msmPortPlanKey, entry, rtspPortName, rtpPortName, rtcpPortName)
+		}
+		if _, ok := result[name]; ok {
+			return nil, fmt.Errorf("duplicate %v entry for %v", msmPortPlanKey, name)
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil || p < 1 || p > 65535 {
+			return nil, fmt.Errorf("invalid %v entry %q, invalid port", msmPortPlanKey, entry)
+		}
+		if other, ok := used[int32(p)]; ok {
+			return nil, fmt.Errorf("%v assigns port %v to both %v and %v", msmPortPlanKey, p, other, name)
+		}
+		result[name] = int32(p)
+		used[int32(p)] = name
 	}
 
-	return logLvl
+	for _, name := range stubPortNames {
+		if _, ok := result[name]; !ok {
+			return nil, fmt.Errorf("%v is missing a port for %v", msmPortPlanKey, name)
+		}
+	}
+	return result, nil
 }
 
-func getMsmCpEnv() string {
-	return os.Getenv(msmCpEnv)
+// stubContainer returns the injected stub container of the pod spec, if any
+func stubContainer(config *Config, spec *corev1.PodSpec) *corev1.Container {
+	for i := range spec.Containers {
+		if spec.Containers[i].Name == getSidecar(config) {
+			return &spec.Containers[i]
+		}
+	}
+	return nil
 }
 
-func getMsmDpEnv() string {
-	return os.Getenv(msmDpEnv)
+func getStubImage(config *Config) string {
+	return fmt.Sprintf("%s/%s:%s", getRepo(config), getSidecar(config), getTag(config))
 }
 
-func (w *MsmWebhook) applyDeploymentKind(patches []patchOperation, kind string) {
-	switch kind {
-	case pod:
-		return
-	case deployment:
-		for i := 0; i < len(patches); i++ {
-			patches[i].Path = deploymentSubPath + patches[i].Path
-		}
-	case daemonSet:
-		for i := 0; i < len(patches); i++ {
-			patches[i].Path = deploymentSubPath + patches[i].Path
+// certMode returns the configured certificate mode, defaulting to file when
+// only a certificate directory is set
+func certMode() (string, error) {
+	mode := CertMode
+	if mode == "" {
+		mode = certModeSelfSigned
+		if CertDir != "" {
+			mode = certModeFile
 		}
-	case statefulSet:
-		for i := 0; i < len(patches); i++ {
-			patches[i].Path = deploymentSubPath + patches[i].Path
+	}
+
+	switch mode {
+	case certModeSelfSigned:
+		return mode, nil
+	case certModeFile, certModeCertManager:
+		if CertDir == "" {
+			return "", fmt.Errorf("certificate mode %v requires a certificate directory", mode)
 		}
+		return mode, nil
 	default:
-		w.Log.Fatalf(unsupportedKind, kind)
+		return "", fmt.Errorf("unknown certificate mode %v, expect one of %v, %v, %v",
+			mode, certModeSelfSigned, certModeFile, certModeCertManager)
 	}
 }
 
+func getPullPolicyValue(config *Config) corev1.PullPolicy {
+	return corev1.PullPolicy(config.Injection.ImagePullPolicy)
+}
+
+func getRepo(config *Config) string {
+	return config.Injection.Repo
+}
+
+func getSidecar(config *Config) string {
+	return config.Injection.Sidecar
+}
+
+func getTag(config *Config) string {
+	return config.Injection.Tag
+}
+
+func getMsmLogLvl(config *Config) string {
+	return config.Injection.LogLevel
+}
+
+// getEnabledWarnings returns the configured warnings, all of them when unset
+func getEnabledWarnings(config *Config) map[string]bool {
+	result := make(map[string]bool)
+	value := strings.TrimSpace(config.Injection.Warnings)
+	if value == "" {
+		for _, c := range warningChecks {
+			result[c.name] = true
+		}
+		return result
+	}
+
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != noWarnings {
+			result[name] = true
+		}
+	}
+	return result
+}
+
+func getMsmCpEnv(config *Config) string {
+	return config.Injection.ControlPlane
+}
+
+func getMsmDpEnv(config *Config) string {
+	return config.Injection.DataPlane
+}
+
+// getIgnoredNamespaces returns the namespaces never injected
+func getIgnoredNamespaces(config *Config) []string {
+	return append([]string{metav1.NamespaceSystem, metav1.NamespacePublic},
+		config.Injection.IgnoredNamespaces...)
+}
+
 /* Unused Function
 func getFieldPath(name string, path string) corev1.EnvVar {
 	env := corev1.EnvVar{
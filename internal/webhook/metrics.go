@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"context"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/admission/v1"
+)
+
+const metricsNamespace = "msm_admission_webhook"
+
+// Version of the webhook, set at build time
+var Version = "dev"
+
+//nolint:exhaustruct
+var admissionRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "admission_requests_total",
+	Help:      "Number of admission requests, by handler, kind, namespace, operation, outcome and dry run.",
+}, []string{"handler", "kind", "namespace", "operation", "outcome", "dry_run"})
+
+//nolint:exhaustruct
+var admissionDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: metricsNamespace,
+	Name:      "admission_duration_seconds",
+	Help:      "Time spent handling admission requests, by handler.",
+	Buckets:   []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+}, []string{"handler"})
+
+//nolint:exhaustruct
+var patchSizeBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: metricsNamespace,
+	Name:      "patch_size_bytes",
+	Help:      "Size of the returned JSON patches, by kind.",
+	Buckets:   prometheus.ExponentialBuckets(256, 2, 10),
+}, []string{"kind"})
+
+//nolint:exhaustruct
+var registrationErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "registration_errors_total",
+	Help:      "Number of failed webhook configuration registrations, by configuration kind.",
+}, []string{"config_kind"})
+
+//nolint:exhaustruct
+var reconcileErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "reconcile_errors_total",
+	Help:      "Number of drifted webhook configurations that could not be restored, by configuration kind.",
+}, []string{"config_kind"})
+
+//nolint:exhaustruct
+var buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "build_info",
+	Help:      "Build information of the webhook, always 1.",
+}, []string{"version", "goversion"})
+
+//nolint:exhaustruct
+var warningsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "warnings_total",
+	Help:      "Number of admission warnings returned, by warning.",
+}, []string{"warning"})
+
+//nolint:exhaustruct
+var patchVerificationFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "patch_verification_failures_total",
+	Help:      "Number of generated patches that failed verification, by kind.",
+}, []string{"kind"})
+
+//nolint:exhaustruct
+var webhookConfigDriftsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "webhook_config_drifts_total",
+	Help:      "Number of drifted webhook configurations restored, by configuration.",
+}, []string{"config"})
+
+var certExpiryDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(metricsNamespace, "", "certificate_expiry_seconds"),
+	"Seconds left before the certificate expires, by certificate.",
+	[]string{"certificate"}, nil,
+)
+
+// certExpiryCollector reports the time left on the served certificates when
+// scraped, so the value never goes stale between rotations
+type certExpiryCollector struct {
+	w *MsmWebhook
+}
+
+func (c certExpiryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- certExpiryDesc
+}
+
+func (c certExpiryCollector) Collect(ch chan<- prometheus.Metric) {
+	if cert, err := c.w.getCertificate(nil); err == nil && cert.Leaf != nil {
+		ch <- prometheus.MustNewConstMetric(certExpiryDesc, prometheus.GaugeValue,
+			time.Until(cert.Leaf.NotAfter).Seconds(), "serving")
+	}
+	if notAfter, ok := c.w.caNotAfter(); ok {
+		ch <- prometheus.MustNewConstMetric(certExpiryDesc, prometheus.GaugeValue,
+			time.Until(notAfter).Seconds(), "ca")
+	}
+}
+
+// observeAdmission records the outcome of an admission request. The labels
+// are bounded by the webhook rules and the namespaces, never by object names.
+// Dry runs are counted too, under their own label: metrics only describe the
+// webhook, they change nothing in the cluster.
+func observeAdmission(a *admissionContext, handler string, response *v1.AdmissionResponse) {
+	if isProbe(a.ctx) {
+		return
+	}
+	outcome := a.decision
+	if outcome == "" {
+		outcome = decisionAllowed
+		if !response.Allowed {
+			outcome = decisionDenied
+		}
+	}
+	admissionRequestsTotal.WithLabelValues(handler, a.request.Kind.Kind, a.request.Namespace,
+		string(a.request.Operation), outcome, strconv.FormatBool(a.dryRun)).Inc()
+	if len(response.Patch) > 0 {
+		patchSizeBytes.WithLabelValues(a.request.Kind.Kind).Observe(float64(len(response.Patch)))
+	}
+}
+
+// observeDuration records the latency of an admission request, from the
+// moment its body is read
+func observeDuration(ctx context.Context, handler string, start time.Time) {
+	if isProbe(ctx) {
+		return
+	}
+	admissionDurationSeconds.WithLabelValues(handler).Observe(time.Since(start).Seconds())
+}
+
+func init() {
+	buildInfo.WithLabelValues(Version, runtime.Version()).Set(1)
+	prometheus.MustRegister(
+		admissionRequestsTotal,
+		admissionDurationSeconds,
+		patchSizeBytes,
+		registrationErrorsTotal,
+		reconcileErrorsTotal,
+		buildInfo,
+		warningsTotal,
+		patchVerificationFailuresTotal,
+		webhookConfigDriftsTotal,
+	)
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	v1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// histogramSamples returns the sample count and sum of a histogram
+func histogramSamples(t *testing.T, h prometheus.Observer) (uint64, float64) {
+	t.Helper()
+	var m dto.Metric
+	if err := h.(prometheus.Metric).Write(&m); err != nil { //nolint:forcetypeassert
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestObserveAdmission(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		w := newTestWebhook()
+		request := testRequest(t, map[string]string{msmLabelKey: "true"})
+		request.DryRun = &dryRun
+		counter := admissionRequestsTotal.WithLabelValues(mutateHandler, pod, "media", string(v1.Create),
+			decisionInjected, strconv.FormatBool(dryRun))
+		requests := testutil.ToFloat64(counter)
+		patches, _ := histogramSamples(t, patchSizeBytes.WithLabelValues(pod))
+
+		w.mutate(context.Background(), currentConfig(), &request)
+
+		if got := testutil.ToFloat64(counter); got != requests+1 {
+			t.Errorf("dry run %v: expected the request to be counted, got %v after %v", dryRun, got, requests)
+		}
+		if got, _ := histogramSamples(t, patchSizeBytes.WithLabelValues(pod)); got != patches+1 {
+			t.Errorf("dry run %v: expected the patch size to be observed", dryRun)
+		}
+	}
+}
+
+// slowReader delays the request body, as a slow client upload would
+type slowReader struct {
+	io.Reader
+	delay time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	r.delay = 0
+	return r.Reader.Read(p)
+}
+
+//nolint:exhaustruct
+func TestHandleObservesDuration(t *testing.T) {
+	w := newTestWebhook()
+	request := testRequest(t, nil)
+	body, err := json.Marshal(v1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{Kind: admissionReviewKind, APIVersion: v1.SchemeGroupVersion.String()},
+		Request:  &request,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, sum := histogramSamples(t, admissionDurationSeconds.WithLabelValues(mutateHandler))
+
+	delay := 50 * time.Millisecond
+	req := httptest.NewRequest(http.MethodPost, mutateMethod, &slowReader{Reader: bytes.NewReader(body), delay: delay})
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	w.handle(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %v: %v", rec.Code, rec.Body.String())
+	}
+
+	gotCount, gotSum := histogramSamples(t, admissionDurationSeconds.WithLabelValues(mutateHandler))
+	if gotCount != count+1 {
+		t.Fatalf("expected one observation, got %v", gotCount-count)
+	}
+	if gotSum-sum < delay.Seconds() {
+		t.Errorf("expected the latency to include reading and decoding, got %v", gotSum-sum)
+	}
+}
+
+func TestProbeHandlerSkipsMetrics(t *testing.T) {
+	w := newTestWebhook()
+	requests := admissionRequestsTotal.WithLabelValues(validateHandler, pod, "", string(v1.Create), decisionSkipped, "true")
+	before := testutil.ToFloat64(requests)
+	count, _ := histogramSamples(t, admissionDurationSeconds.WithLabelValues(validateHandler))
+
+	if err := w.probeHandler(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := testutil.ToFloat64(requests); got != before {
+		t.Errorf("expected the probe not to be counted, got %v more requests", got-before)
+	}
+	if got, _ := histogramSamples(t, admissionDurationSeconds.WithLabelValues(validateHandler)); got != count {
+		t.Errorf("expected the probe latency not to be observed, got %v more", got-count)
+	}
+}
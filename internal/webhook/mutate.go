@@ -17,13 +17,19 @@
 package webhook
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/url"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	v1 "k8s.io/api/admission/v1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 type NSUrl struct {
@@ -32,9 +38,22 @@ type NSUrl struct {
 	Params url.Values
 }
 
+type RTSPSource struct {
+	Scheme string
+	Host   string
+	Path   string
+	Params url.Values
+}
+
+type rtspConfig struct {
+	sources    []*RTSPSource
+	secretName string
+}
+
 type podSpecAndMeta struct {
-	meta *metav1.ObjectMeta
-	spec *corev1.PodSpec
+	object runtime.Object
+	meta   *metav1.ObjectMeta
+	spec   *corev1.PodSpec
 }
 
 type patchOperation struct {
@@ -43,50 +62,138 @@ type patchOperation struct {
 	Value interface{} `json:"value,omitempty"`
 }
 
-var IgnoredNamespaces = []string{
-	metav1.NamespaceSystem,
-	metav1.NamespacePublic,
-}
-
-//nolint:exhaustruct
-func (w *MsmWebhook) mutate(request *v1.AdmissionRequest) *v1.AdmissionResponse {
+func (w *MsmWebhook) mutate(ctx context.Context, config *Config, request *v1.AdmissionRequest) *v1.AdmissionResponse {
 	w.Log.Debugf("AdmissionReview for request UID %s, Kind %s, "+
 		"Resource %s, Name %s, Namespace %s, Operation %s ",
 		request.UID, request.Kind, request.Resource, request.Name,
 		request.Namespace, request.Operation)
 
-	if !isSupportKind(request) {
+	a := newAdmissionContext(ctx, config, request)
+	defer w.finish(a)
+
+	response := w.inject(a)
+	response.AuditAnnotations = a.auditAnnotations()
+	observeAdmission(a, mutateHandler, response)
+	trace.SpanFromContext(ctx).SetAttributes(decisionAttributes(a, response)...)
+	return response
+}
+
+// inject decides whether the stub is injected into the requested workload
+// and renders the patch doing so
+func (w *MsmWebhook) inject(a *admissionContext) *v1.AdmissionResponse {
+	if !isSupportKind(a.request) {
+		a.decide(decisionSkipped, ruleUnsupportedKind)
 		return okReviewResponse()
 	}
 
-	metaAndSpec, err := w.getMetaAndSpec(request)
+	metaAndSpec, err := w.getMetaAndSpec(a)
 	if err != nil {
+		a.decide(decisionDenied, ruleInvalidObject)
 		return errorReviewResponse(err)
 	}
 
-	value, ok := w.msmLabelValue(IgnoredNamespaces, metaAndSpec)
+	if response := w.injectionPolicy(a, metaAndSpec); response != nil {
+		return response
+	}
+	return w.injectionPatch(a, metaAndSpec)
+}
+
+// injectionPolicy answers the admission when the stub must not be injected,
+// it returns nil when the workload gets the stub
+func (w *MsmWebhook) injectionPolicy(a *admissionContext, metaAndSpec *podSpecAndMeta) *v1.AdmissionResponse {
+	_, span := startSpan(a.ctx, "policy")
+	defer span.End()
+
+	value, ok := w.msmLabelValue(a, getIgnoredNamespaces(a.config), metaAndSpec)
 	if !ok {
-		w.Log.Infof("Skipping validation for %s/%s due to policy check", metaAndSpec.meta.Namespace, metaAndSpec.meta.Name)
+		w.logDecision(a, "Skipping validation for %s/%s due to policy check", metaAndSpec.meta.Namespace, metaAndSpec.meta.Name)
 		return okReviewResponse()
 	}
 
-	if err = w.validateAnnotationValue(value); err != nil {
-		return errorReviewResponse(err)
+	if err := w.validateAnnotationValue(value); err != nil {
+		a.decide(decisionDenied, ruleInvalidAnnotation)
+		return failSpan(span, err)
+	}
+
+	if stubContainer(a.config, metaAndSpec.spec) != nil {
+		a.decide(decisionSkipped, ruleStubPresent)
+		w.logDecision(a, "Skipping injection for %s/%s, stub already present", metaAndSpec.meta.Namespace, metaAndSpec.meta.Name)
+		response := okReviewResponse()
+		response.Warnings = w.warnings(a, metaAndSpec)
+		return response
+	}
+
+	// the containers of an existing pod cannot be changed, an older
+	// registration may still send pod updates
+	if a.request.Operation == v1.Update && a.request.Kind.Kind == pod {
+		a.decide(decisionSkipped, ruleUnmeshedWorkload)
+		w.logDecision(a, "Skipping injection for %s/%s, pod containers cannot be updated",
+			metaAndSpec.meta.Namespace, metaAndSpec.meta.Name)
+		return okReviewResponse()
+	}
+	return nil
+}
+
+// injectionPatch renders the stub and the patch injecting it
+func (w *MsmWebhook) injectionPatch(a *admissionContext, metaAndSpec *podSpecAndMeta) *v1.AdmissionResponse {
+	ctx, span := startSpan(a.ctx, "patch")
+	defer span.End()
+
+	request := a.request
+	rtsp, err := w.rtspConfig(metaAndSpec)
+	if err != nil {
+		a.decide(decisionDenied, ruleInvalidAnnotation)
+		return failSpan(span, err)
+	}
+
+	ports, err := portPlan(metaAndSpec)
+	if err != nil {
+		a.decide(decisionDenied, ruleInvalidAnnotation)
+		return failSpan(span, err)
 	}
 
 	// todo - set limits
 	// todo - init container duplication
 
 	// create container to inject into pod
-	patch := createMsmContainerPatch(metaAndSpec)
-	w.applyDeploymentKind(patch, request.Kind.Kind)
+	stub := renderMsmContainer(a.config, rtsp, ports, w.namespaceSettings(ctx, request.Namespace))
+	hash, err := sidecarHash(&stub)
+	if err != nil {
+		a.decide(decisionDenied, rulePatchRendering)
+		return failSpan(span, err)
+	}
+	patch, err := createPatch(metaAndSpec, request.Object.Raw, injectContainer(stub))
+	if err != nil {
+		a.decide(decisionDenied, rulePatchRendering)
+		return failSpan(span, err)
+	}
 	patchBytes, err := json.Marshal(patch)
 	if err != nil {
-		return errorReviewResponse(err)
+		a.decide(decisionDenied, rulePatchRendering)
+		return failSpan(span, err)
+	}
+
+	if err = w.verifyPatch(request.Kind.Kind, request.Object.Raw, patchBytes); err != nil {
+		w.Log.Errorf("Generated patch for %s %s/%s is invalid: %v", request.Kind.Kind,
+			metaAndSpec.meta.Namespace, metaAndSpec.meta.Name, err)
+		a.sideEffect(func() {
+			patchVerificationFailuresTotal.WithLabelValues(request.Kind.Kind).Inc()
+		})
+		a.decide(decisionDenied, rulePatchVerification)
+		return failSpan(span, err)
 	}
 
+	w.logDecision(a, "Injecting %s into %s %s/%s", getSidecar(a.config), request.Kind.Kind,
+		metaAndSpec.meta.Namespace, metaAndSpec.meta.Name)
 	w.Log.Debugf("AdmissionResponse, patch=%v\n", string(patchBytes))
-	return createReviewResponse(patchBytes)
+	a.decide(decisionInjected, ruleInjectLabel)
+	a.injected = true
+	a.stubImage = stub.Image
+	a.sidecarHash = hash
+	span.SetAttributes(attribute.Int("admission.patch_operations", len(patch)))
+	response := createReviewResponse(patchBytes)
+	response.Warnings = w.warnings(a, metaAndSpec)
+	return response
 }
 
 //nolint:exhaustruct
@@ -105,64 +212,89 @@ func createReviewResponse(data []byte) *v1.AdmissionResponse {
 	}
 }
 
-func (w *MsmWebhook) msmLabelValue(ignoredNamespaceList []string, tuple *podSpecAndMeta) (string, bool) {
+func (w *MsmWebhook) msmLabelValue(a *admissionContext, ignoredNamespaceList []string, tuple *podSpecAndMeta) (string, bool) {
 	// skip special kubernetes system namespaces
 	for _, namespace := range ignoredNamespaceList {
 		if tuple.meta.Namespace == namespace {
-			w.Log.Infof("Skip validation for %v for it's in special namespace:%v", tuple.meta.Name, tuple.meta.Namespace)
+			a.decide(decisionSkipped, ruleIgnoredNamespace)
+			w.logDecision(a, "Skip validation for %v for it's in special namespace:%v", tuple.meta.Name, tuple.meta.Namespace)
 			return "", false
 		}
 	}
 
 	labels := tuple.meta.GetLabels()
 	if labels == nil {
-		w.Log.Info("No labels, skip")
+		a.decide(decisionSkipped, ruleNoLabel)
+		w.logDecision(a, "No labels, skip")
 		return "", false
 	}
 
 	value, ok := labels[msmLabelKey]
+	if !ok {
+		a.decide(decisionSkipped, ruleNoLabel)
+	}
 	return value, ok
 }
 
-func (w *MsmWebhook) getMetaAndSpec(request *v1.AdmissionRequest) (*podSpecAndMeta, error) {
-	result := &podSpecAndMeta{
-		meta: nil,
-		spec: nil,
+func (w *MsmWebhook) getMetaAndSpec(a *admissionContext) (*podSpecAndMeta, error) {
+	_, span := startSpan(a.ctx, "decode object")
+	defer span.End()
+
+	metaAndSpec, err := w.decodeMetaAndSpec(a.request.Kind.Kind, a.request.Object.Raw)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 	}
-	switch request.Kind.Kind {
+	return metaAndSpec, err
+}
+
+// decodeMetaAndSpec decodes the raw object of the given kind
+//
+//nolint:exhaustruct
+func (w *MsmWebhook) decodeMetaAndSpec(kind string, raw []byte) (*podSpecAndMeta, error) {
+	var obj runtime.Object
+	switch kind {
 	case deployment:
-		var d appsv1.Deployment
-		if err := json.Unmarshal(request.Object.Raw, &d); err != nil {
-			w.Log.Errorf("Could not unmarshal raw object: %v", err)
-			return nil, err
-		}
-		result.meta = &d.ObjectMeta
-		result.spec = &d.Spec.Template.Spec
+		obj = &appsv1.Deployment{}
 	case pod:
-		var p corev1.Pod
-		if err := json.Unmarshal(request.Object.Raw, &p); err != nil {
-			w.Log.Errorf("Could not unmarshal raw object: %v", err)
-			return nil, err
-		}
-		result.meta = &p.ObjectMeta
-		result.spec = &p.Spec
+		obj = &corev1.Pod{}
 	case statefulSet:
-		var ss appsv1.StatefulSet
-		if err := json.Unmarshal(request.Object.Raw, &ss); err != nil {
-			w.Log.Errorf("Could not unmarshal raw object: %v", err)
-			return nil, err
-		}
-		result.meta = &ss.ObjectMeta
-		result.spec = &ss.Spec.Template.Spec
+		obj = &appsv1.StatefulSet{}
 	case daemonSet:
-		var ds appsv1.StatefulSet
-		if err := json.Unmarshal(request.Object.Raw, &ds); err != nil {
-			w.Log.Errorf("Could not unmarshal raw object: %v", err)
-			return nil, err
-		}
-		result.meta = &ds.ObjectMeta
-		result.spec = &ds.Spec.Template.Spec
+		obj = &appsv1.DaemonSet{}
+	default:
+		return nil, fmt.Errorf(unsupportedKind, kind)
+	}
+
+	if err := json.Unmarshal(raw, obj); err != nil {
+		w.Log.Errorf("Could not unmarshal raw object: %v", err)
+		return nil, err
+	}
+
+	return newPodSpecAndMeta(obj), nil
+}
+
+// newPodSpecAndMeta points into the metadata and pod spec of the workload
+func newPodSpecAndMeta(obj runtime.Object) *podSpecAndMeta {
+	result := &podSpecAndMeta{
+		object: obj,
+		meta:   nil,
+		spec:   nil,
+	}
+	switch o := obj.(type) {
+	case *appsv1.Deployment:
+		result.meta = &o.ObjectMeta
+		result.spec = &o.Spec.Template.Spec
+	case *corev1.Pod:
+		result.meta = &o.ObjectMeta
+		result.spec = &o.Spec
+	case *appsv1.StatefulSet:
+		result.meta = &o.ObjectMeta
+		result.spec = &o.Spec.Template.Spec
+	case *appsv1.DaemonSet:
+		result.meta = &o.ObjectMeta
+		result.spec = &o.Spec.Template.Spec
 	}
 
-	return result, nil
+	return result
 }
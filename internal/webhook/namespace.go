@@ -0,0 +1,243 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+)
+
+// namespaceSettings override the stub defaults for every workload of a
+// namespace, they are read from its well-known ConfigMap
+type namespaceSettings struct {
+	controlPlane string
+	dataPlane    string
+	logLevel     string
+	profile      string
+	resources    *corev1.ResourceRequirements
+}
+
+// namespaceOverrides caches the valid settings of every namespace
+type namespaceOverrides struct {
+	mu          sync.RWMutex
+	byNamespace map[string]*namespaceSettings
+}
+
+// stubProfiles are the resource presets a namespace can pick for the stub
+var stubProfiles = map[string]corev1.ResourceRequirements{
+	profileSmall:  stubResources("50m", "32Mi", "200m", "64Mi"),
+	profileMedium: stubResources("100m", "64Mi", "500m", "128Mi"),
+	profileLarge:  stubResources("250m", "128Mi", "1", "256Mi"),
+}
+
+//nolint:exhaustruct
+func stubResources(cpuRequest, memoryRequest, cpuLimit, memoryLimit string) corev1.ResourceRequirements {
+	return corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse(cpuRequest),
+			corev1.ResourceMemory: resource.MustParse(memoryRequest),
+		},
+		Limits: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse(cpuLimit),
+			corev1.ResourceMemory: resource.MustParse(memoryLimit),
+		},
+	}
+}
+
+// parseNamespaceSettings validates the keys of the namespace ConfigMap, a
+// single invalid key rejects the whole ConfigMap
+func parseNamespaceSettings(cm *corev1.ConfigMap) (*namespaceSettings, error) {
+	s := &namespaceSettings{
+		controlPlane: "",
+		dataPlane:    "",
+		logLevel:     "",
+		profile:      "",
+		resources:    nil,
+	}
+
+	keys := make([]string, 0, len(cm.Data))
+	for key := range cm.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := strings.TrimSpace(cm.Data[key])
+		switch key {
+		case nsControlPlaneKey, nsDataPlaneKey:
+			if _, _, err := net.SplitHostPort(value); err != nil {
+				return nil, fmt.Errorf("invalid %v %q, expect host:port: %w", key, value, err)
+			}
+			if key == nsControlPlaneKey {
+				s.controlPlane = value
+			} else {
+				s.dataPlane = value
+			}
+		case nsLogLevelKey:
+			if _, err := logLevel(value); err != nil || value == "" {
+				return nil, fmt.Errorf("invalid %v %q, expect one of TRACE, DEBUG, INFO, WARN, ERROR, FATAL",
+					key, value)
+			}
+			s.logLevel = value
+		case nsProfileKey:
+			if _, ok := stubProfiles[value]; !ok {
+				return nil, fmt.Errorf("unknown %v %q, expect one of %v, %v, %v",
+					key, value, profileSmall, profileMedium, profileLarge)
+			}
+			s.profile = value
+		case nsResourcesKey:
+			var r corev1.ResourceRequirements
+			if err := yaml.UnmarshalStrict([]byte(value), &r); err != nil {
+				return nil, fmt.Errorf("invalid %v: %w", key, err)
+			}
+			for name, limit := range r.Limits {
+				if request, ok := r.Requests[name]; ok && request.Cmp(limit) > 0 {
+					return nil, fmt.Errorf("invalid %v: %v request %v exceeds its limit %v",
+						key, name, request.String(), limit.String())
+				}
+			}
+			s.resources = &r
+		default:
+			return nil, fmt.Errorf("unknown key %v, expect %v, %v, %v, %v or %v", key,
+				nsControlPlaneKey, nsDataPlaneKey, nsLogLevelKey, nsProfileKey, nsResourcesKey)
+		}
+	}
+	return s, nil
+}
+
+// apply overrides the defaults of the rendered stub, explicit resources win
+// over the profile
+func (s *namespaceSettings) apply(c *corev1.Container) {
+	if s == nil {
+		return
+	}
+	for i, env := range c.Env {
+		switch {
+		case env.Name == msmCpEnv && s.controlPlane != "":
+			c.Env[i].Value = s.controlPlane
+		case env.Name == msmDpEnv && s.dataPlane != "":
+			c.Env[i].Value = s.dataPlane
+		case env.Name == msmLogLvlEnv && s.logLevel != "":
+			c.Env[i].Value = s.logLevel
+		}
+	}
+	if s.profile != "" {
+		profile := stubProfiles[s.profile]
+		c.Resources = *profile.DeepCopy()
+	}
+	if s.resources != nil {
+		c.Resources = *s.resources.DeepCopy()
+	}
+}
+
+// namespaceSettings returns the settings of the namespace, nil when it has
+// no valid ConfigMap
+func (w *MsmWebhook) namespaceSettings(ctx context.Context, namespace string) *namespaceSettings {
+	_, span := startSpan(ctx, "namespace settings lookup", trace.WithAttributes(
+		attribute.String("k8s.namespace.name", namespace)))
+	defer span.End()
+
+	w.overrides.mu.RLock()
+	defer w.overrides.mu.RUnlock()
+	s := w.overrides.byNamespace[namespace]
+	span.SetAttributes(attribute.Bool("found", s != nil))
+	return s
+}
+
+func (w *MsmWebhook) setNamespaceSettings(namespace string, s *namespaceSettings) {
+	w.overrides.mu.Lock()
+	defer w.overrides.mu.Unlock()
+	if w.overrides.byNamespace == nil {
+		w.overrides.byNamespace = make(map[string]*namespaceSettings)
+	}
+	if s == nil {
+		delete(w.overrides.byNamespace, namespace)
+		return
+	}
+	w.overrides.byNamespace[namespace] = s
+}
+
+// watchNamespaceSettings keeps the settings of every namespace in sync with
+// its ConfigMap, an invalid ConfigMap is reported with an Event and the
+// namespace falls back to the defaults. It waits a bounded time for the
+// ConfigMaps to be listed.
+func (w *MsmWebhook) watchNamespaceSettings(ctx context.Context, name string) {
+	factory := informers.NewSharedInformerFactoryWithOptions(w.kube, 0,
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}))
+
+	load := func(obj interface{}) {
+		cm, ok := obj.(*corev1.ConfigMap)
+		if !ok {
+			return
+		}
+		s, err := parseNamespaceSettings(cm)
+		if err != nil {
+			w.Log.Warnf("Ignoring injection settings %v/%v: %v", cm.Namespace, cm.Name, err)
+			w.recorder.Eventf(cm, corev1.EventTypeWarning, eventReasonInvalidSettings,
+				"Ignoring injection settings, using the defaults: %v", err)
+		} else {
+			w.Log.Infof("Loaded injection settings %v/%v", cm.Namespace, cm.Name)
+		}
+		w.setNamespaceSettings(cm.Namespace, s)
+	}
+
+	//nolint:exhaustruct
+	_, err := factory.Core().V1().ConfigMaps().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    load,
+		UpdateFunc: func(_, obj interface{}) { load(obj) },
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if cm, ok := obj.(*corev1.ConfigMap); ok {
+				w.setNamespaceSettings(cm.Namespace, nil)
+			}
+		},
+	})
+	if err != nil {
+		w.Log.Errorf("Could not watch ConfigMaps %v: %v", name, err)
+		return
+	}
+	factory.Start(ctx.Done())
+
+	// a missing permission would otherwise block Init forever, the
+	// informer keeps retrying in the background
+	syncCtx, cancel := context.WithTimeout(ctx, namespaceSettingsSyncWait)
+	defer cancel()
+	for _, synced := range factory.WaitForCacheSync(syncCtx.Done()) {
+		if !synced && ctx.Err() == nil {
+			w.Log.Errorf("ConfigMaps %v not listed after %v, check that the webhook can list and watch "+
+				"ConfigMaps, namespaces use the defaults meanwhile", name, namespaceSettingsSyncWait)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+//nolint:exhaustruct
+func settingsConfigMap(namespace string, data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "msm-injection", Namespace: namespace},
+		Data:       data,
+	}
+}
+
+func TestParseNamespaceSettings(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data map[string]string
+		err  string
+	}{
+		{name: "empty", data: nil},
+		{name: "all keys", data: map[string]string{
+			"controlPlane": "msm-cp.msm:9000",
+			"dataPlane":    "msm-dp.msm:8050",
+			"logLevel":     "DEBUG",
+			"profile":      "large",
+			"resources":    "requests:\n  cpu: 10m\nlimits:\n  cpu: 20m\n",
+		}},
+		{name: "unknown key", data: map[string]string{"image": "x"}, err: "unknown key image"},
+		{name: "no port", data: map[string]string{"controlPlane": "msm-cp"}, err: "invalid controlPlane"},
+		{name: "log level", data: map[string]string{"logLevel": "LOUD"}, err: "invalid logLevel"},
+		{name: "profile", data: map[string]string{"profile": "huge"}, err: "unknown profile"},
+		{name: "unknown resource field", data: map[string]string{"resources": "request:\n  cpu: 10m\n"},
+			err: "invalid resources"},
+		{name: "request over limit", data: map[string]string{"resources": "requests:\n  cpu: 1\nlimits:\n  cpu: 10m\n"},
+			err: "exceeds its limit"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseNamespaceSettings(settingsConfigMap("apps", tc.data))
+			switch {
+			case tc.err == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Fatalf("expected error %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestNamespaceSettingsApply(t *testing.T) {
+	s, err := parseNamespaceSettings(settingsConfigMap("apps", map[string]string{
+		"controlPlane": "msm-cp.apps:9000",
+		"logLevel":     "DEBUG",
+		"profile":      "small",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := currentConfig()
+	stub := renderMsmContainer(config, nil, nil, s)
+	env := map[string]string{}
+	for _, e := range stub.Env {
+		env[e.Name] = e.Value
+	}
+	if env[msmCpEnv] != "msm-cp.apps:9000" || env[msmLogLvlEnv] != "DEBUG" || env[msmDpEnv] != getMsmDpEnv(config) {
+		t.Fatalf("unexpected env %v", env)
+	}
+	if !stub.Resources.Limits.Memory().Equal(resource.MustParse("64Mi")) {
+		t.Fatalf("expected the small profile, got %v", stub.Resources)
+	}
+
+	// explicit resources win over the profile
+	s.resources = &corev1.ResourceRequirements{ //nolint:exhaustruct
+		Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+	}
+	stub = renderMsmContainer(config, nil, nil, s)
+	if !stub.Resources.Limits.Memory().Equal(resource.MustParse("1Gi")) || stub.Resources.Requests != nil {
+		t.Fatalf("expected the explicit resources, got %v", stub.Resources)
+	}
+}
+
+func TestWatchNamespaceSettings(t *testing.T) {
+	w, clientset := newRegistrationTestWebhook(
+		settingsConfigMap("apps", map[string]string{"logLevel": "DEBUG"}),
+		settingsConfigMap("broken", map[string]string{"profile": "huge"}),
+	)
+	recorder := record.NewFakeRecorder(10)
+	w.recorder = recorder
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w.watchNamespaceSettings(ctx, "msm-injection")
+
+	if s := w.namespaceSettings(ctx, "apps"); s == nil || s.logLevel != "DEBUG" {
+		t.Fatalf("expected the apps settings, got %+v", s)
+	}
+	if s := w.namespaceSettings(ctx, "broken"); s != nil {
+		t.Fatalf("expected the malformed ConfigMap to be ignored, got %+v", s)
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, eventReasonInvalidSettings) {
+			t.Fatalf("unexpected event %v", event)
+		}
+	default:
+		t.Fatal("expected an event for the malformed ConfigMap")
+	}
+
+	err := clientset.CoreV1().ConfigMaps("apps").Delete(ctx, "msm-injection", metav1.DeleteOptions{}) //nolint:exhaustruct
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for w.namespaceSettings(ctx, "apps") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the deleted ConfigMap to be forgotten")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
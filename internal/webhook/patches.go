@@ -17,32 +17,126 @@
 package webhook
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"strings"
 
+	jsonpatch5 "github.com/evanphx/json-patch/v5"
+	"gomodules.xyz/jsonpatch/v2"
 	corev1 "k8s.io/api/core/v1"
 )
 
+// injector edits the deep copy of the workload that is diffed into the patch
+type injector func(tuple *podSpecAndMeta)
+
+// createPatch runs the injectors against a deep copy of the workload and
+// returns the operations turning the raw request object into the mutated
+// workload
+func createPatch(tuple *podSpecAndMeta, raw []byte, injectors ...injector) ([]patchOperation, error) {
+	mutated := newPodSpecAndMeta(tuple.object.DeepCopyObject())
+	for _, inject := range injectors {
+		inject(mutated)
+	}
+
+	// both typed sides go through the same serialization so only the
+	// injected changes show up in their diff
+	original, err := json.Marshal(tuple.object)
+	if err != nil {
+		return nil, err
+	}
+	modified, err := json.Marshal(mutated.object)
+	if err != nil {
+		return nil, err
+	}
+	typedOps, err := jsonpatch.CreatePatch(original, modified)
+	if err != nil {
+		return nil, err
+	}
+	injected, err := json.Marshal(typedOps)
+	if err != nil {
+		return nil, err
+	}
+
+	// the typed objects drop unknown fields and carry defaults the request
+	// may not have, replaying the injected changes on the raw object keeps
+	// the patch relative to what the API server holds
+	changes, err := jsonpatch5.DecodePatch(injected)
+	if err != nil {
+		return nil, err
+	}
+	target, err := changes.Apply(raw)
+	if err != nil {
+		return nil, fmt.Errorf("injected changes do not apply to the request object: %w", err)
+	}
+
+	ops, err := jsonpatch.CreatePatch(raw, target)
+	if err != nil {
+		return nil, err
+	}
+
+	patch := make([]patchOperation, 0, len(ops))
+	for _, op := range ops {
+		patch = append(patch, patchOperation{
+			Op:    op.Operation,
+			Path:  op.Path,
+			Value: op.Value,
+		})
+	}
+	return patch, nil
+}
+
+// injectContainer appends the container to the pod spec
+func injectContainer(c corev1.Container) injector {
+	return func(tuple *podSpecAndMeta) {
+		tuple.spec.Containers = append(tuple.spec.Containers, c)
+	}
+}
+
+// renderMsmContainer returns the stub container injected into the workload
+func renderMsmContainer(config *Config, rtsp *rtspConfig, ports map[string]int32,
+	settings *namespaceSettings,
+) corev1.Container {
+	msmProxyContainer := msmStubContainer(config, ports)
+	settings.apply(&msmProxyContainer)
+	msmProxyContainer.Env = append(msmProxyContainer.Env, rtspEnv(rtsp)...)
+	return msmProxyContainer
+}
+
+// sidecarHash returns a digest identifying the rendered stub container
+func sidecarHash(c *corev1.Container) (string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// msmStubContainer returns the stub container listening on the given ports
+//
 //nolint:exhaustruct
-func createMsmContainerPatch(tuple *podSpecAndMeta) (patch []patchOperation) {
-	uid := int64(1337)
-	msmProxyContainer := corev1.Container{
-		Name:            getSidecar(),
-		Image:           fmt.Sprintf("%s/%s:%s", getRepo(), getSidecar(), getTag()),
-		ImagePullPolicy: getPullPolicyValue(),
+func msmStubContainer(config *Config, ports map[string]int32) corev1.Container {
+	uid := int64(stubUID)
+	return corev1.Container{
+		Name:            getSidecar(config),
+		Image:           getStubImage(config),
+		ImagePullPolicy: getPullPolicyValue(config),
 		Ports: []corev1.ContainerPort{
 			{
-				Name:          "rtsp",
-				ContainerPort: 8554,
+				Name:          rtspPortName,
+				ContainerPort: ports[rtspPortName],
 				Protocol:      corev1.ProtocolTCP,
 			},
 			{
-				Name:          "rtp",
-				ContainerPort: 8050,
+				Name:          rtpPortName,
+				ContainerPort: ports[rtpPortName],
 				Protocol:      corev1.ProtocolUDP,
 			},
 			{
-				Name:          "rtcp",
-				ContainerPort: 8051,
+				Name:          rtcpPortName,
+				ContainerPort: ports[rtcpPortName],
 				Protocol:      corev1.ProtocolUDP,
 			},
 		},
@@ -55,15 +149,15 @@ func createMsmContainerPatch(tuple *podSpecAndMeta) (patch []patchOperation) {
 		Env: []corev1.EnvVar{
 			{
 				Name:  msmLogLvlEnv,
-				Value: getMsmLogLvl(),
+				Value: getMsmLogLvl(config),
 			},
 			{
 				Name:  msmCpEnv,
-				Value: getMsmCpEnv(),
+				Value: getMsmCpEnv(config),
 			},
 			{
 				Name:  msmDpEnv,
-				Value: getMsmDpEnv(),
+				Value: getMsmDpEnv(config),
 			},
 			{
 				Name: podName,
@@ -107,28 +201,47 @@ func createMsmContainerPatch(tuple *podSpecAndMeta) (patch []patchOperation) {
 			},
 		},
 	}
+}
 
-	patch = append(patch, addContainer(tuple.spec, []corev1.Container{msmProxyContainer})...)
+// rtspEnv passes the upstream RTSP sources to the stub, credentials are only
+// ever referenced from the Secret and never copied into the pod spec
+//
+//nolint:exhaustruct
+func rtspEnv(rtsp *rtspConfig) []corev1.EnvVar {
+	if rtsp == nil || len(rtsp.sources) == 0 {
+		return nil
+	}
 
-	return patch
-}
+	sources := make([]string, 0, len(rtsp.sources))
+	for _, s := range rtsp.sources {
+		sources = append(sources, s.String())
+	}
 
-func addContainer(spec *corev1.PodSpec, containers []corev1.Container) (patch []patchOperation) {
-	first := len(spec.Containers) == 0
-	for i := 0; i < len(containers); i++ {
-		value := &containers[i]
-		path := containersPath
-		if first {
-			first = false
-		} else {
-			path += "/-"
-		}
-		patch = append(patch, patchOperation{
-			Op:    "add",
-			Path:  path,
-			Value: value,
-		})
+	env := []corev1.EnvVar{
+		{
+			Name:  rtspSourcesEnv,
+			Value: strings.Join(sources, ","),
+		},
+	}
+	if rtsp.secretName == "" {
+		return env
 	}
 
-	return patch
+	for _, ref := range []struct{ name, key string }{
+		{rtspUserEnv, rtspSecretUserKey},
+		{rtspPassEnv, rtspSecretPassKey},
+	} {
+		env = append(env, corev1.EnvVar{
+			Name: ref.name,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: rtsp.secretName,
+					},
+					Key: ref.key,
+				},
+			},
+		})
+	}
+	return env
 }
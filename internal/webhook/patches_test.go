@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"testing"
+)
+
+func TestCreatePatch(t *testing.T) {
+	// the raw objects lack the defaults of the typed structs and carry a
+	// field they do not know about
+	podSpec := `{"containers":[{"name":"app","image":"app:1.0","x-unknown":true}]}`
+	for _, tc := range []struct {
+		kind string
+		raw  string
+		path string
+	}{
+		{kind: pod, path: "/spec/containers/1",
+			raw: `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"camera"},"spec":` + podSpec + `}`},
+		{kind: deployment, path: "/spec/template/spec/containers/1",
+			raw: `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"camera"},` +
+				`"spec":{"selector":{"matchLabels":{"app":"camera"}},"template":{"spec":` + podSpec + `}}}`},
+		{kind: statefulSet, path: "/spec/template/spec/containers/1",
+			raw: `{"apiVersion":"apps/v1","kind":"StatefulSet","metadata":{"name":"camera"},` +
+				`"spec":{"serviceName":"camera","template":{"spec":` + podSpec + `}}}`},
+		{kind: daemonSet, path: "/spec/template/spec/containers/1",
+			raw: `{"apiVersion":"apps/v1","kind":"DaemonSet","metadata":{"name":"camera"},` +
+				`"spec":{"template":{"metadata":{"labels":{"app":"camera"}},"spec":` + podSpec + `}}}`},
+	} {
+		t.Run(tc.kind, func(t *testing.T) {
+			w := newTestWebhook()
+			tuple, err := w.decodeMetaAndSpec(tc.kind, []byte(tc.raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stub := testStub()
+			patch, err := createPatch(tuple, []byte(tc.raw), injectContainer(stub))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(patch) != 1 || patch[0].Op != "add" || patch[0].Path != tc.path {
+				t.Fatalf("expected a single add of %v, got %+v", tc.path, patch)
+			}
+			value, ok := patch[0].Value.(map[string]interface{})
+			if !ok || value["name"] != stub.Name || value["image"] != stub.Image {
+				t.Fatalf("expected the stub container as value, got %v", patch[0].Value)
+			}
+		})
+	}
+}
@@ -0,0 +1,314 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+var errNotSigner = errors.New("private key cannot sign")
+
+// certOptions configures the certificates generated by the webhook
+type certOptions struct {
+	keyAlgorithm  string
+	validity      time.Duration
+	caValidity    time.Duration
+	serviceName   string
+	extraDNSNames []string
+	extraIPs      []net.IP
+	customized    bool
+}
+
+// parseCertOptions parses and checks the certificate settings, rejecting
+// combinations that would produce unusable certificates
+func parseCertOptions(mode string) (*certOptions, error) {
+	opts := &certOptions{
+		keyAlgorithm:  keyAlgorithmRSA,
+		validity:      servingValidity,
+		caValidity:    caValidity,
+		serviceName:   msmServiceName,
+		extraDNSNames: nil,
+		extraIPs:      nil,
+		customized:    false,
+	}
+
+	if CertKeyAlgorithm != "" {
+		opts.customized = true
+		opts.keyAlgorithm = strings.ToLower(CertKeyAlgorithm)
+		switch opts.keyAlgorithm {
+		case keyAlgorithmRSA, keyAlgorithmECDSA, keyAlgorithmEd25519:
+		default:
+			return nil, fmt.Errorf("unknown key algorithm %v, expect one of %v, %v, %v",
+				CertKeyAlgorithm, keyAlgorithmRSA, keyAlgorithmECDSA, keyAlgorithmEd25519)
+		}
+	}
+
+	for _, d := range []struct {
+		name  string
+		value string
+		into  *time.Duration
+	}{
+		{name: "certificate validity", value: CertValidity, into: &opts.validity},
+		{name: "CA validity", value: CAValidity, into: &opts.caValidity},
+	} {
+		if d.value == "" {
+			continue
+		}
+		opts.customized = true
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v %q: %w", d.name, d.value, err)
+		}
+		*d.into = v
+	}
+	if opts.validity < minServingValidity {
+		return nil, fmt.Errorf("certificate validity %v is shorter than %v", opts.validity, minServingValidity)
+	}
+	if opts.validity >= opts.caRenewBefore() {
+		return nil, fmt.Errorf("certificate validity %v must be shorter than a tenth of the CA validity %v",
+			opts.validity, opts.caValidity)
+	}
+
+	if ServiceName != "" {
+		opts.serviceName = ServiceName
+		if errs := validation.IsDNS1035Label(ServiceName); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid service name %q: %v", ServiceName, strings.Join(errs, ", "))
+		}
+	}
+
+	for _, san := range strings.Split(CertExtraSANs, ",") {
+		san = strings.TrimSpace(san)
+		if san == "" {
+			continue
+		}
+		opts.customized = true
+		if ip := net.ParseIP(san); ip != nil {
+			opts.extraIPs = append(opts.extraIPs, ip)
+			continue
+		}
+		if errs := validation.IsWildcardDNS1123Subdomain(san); len(errs) == 0 {
+			opts.extraDNSNames = append(opts.extraDNSNames, san)
+			continue
+		}
+		if errs := validation.IsDNS1123Subdomain(san); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid SAN %q: %v", san, strings.Join(errs, ", "))
+		}
+		opts.extraDNSNames = append(opts.extraDNSNames, san)
+	}
+
+	if opts.customized && mode != certModeSelfSigned {
+		return nil, fmt.Errorf("certificate key, validity and SAN settings only apply to the %v mode, not %v",
+			certModeSelfSigned, mode)
+	}
+	return opts, nil
+}
+
+// caRenewBefore is how long before its expiry the CA is rotated
+func (o *certOptions) caRenewBefore() time.Duration {
+	return o.caValidity / 10
+}
+
+// generateKey generates a private key with the configured algorithm
+func (o *certOptions) generateKey() (crypto.Signer, error) {
+	switch o.keyAlgorithm {
+	case keyAlgorithmECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case keyAlgorithmEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+}
+
+// keyUsage returns the key usages allowed for the configured algorithm, key
+// encipherment only applies to RSA
+func (o *certOptions) keyUsage() x509.KeyUsage {
+	if o.keyAlgorithm == keyAlgorithmRSA {
+		return x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+	}
+	return x509.KeyUsageDigitalSignature
+}
+
+// newCA generates a long-lived CA, returned with its key as PEM
+func (w *MsmWebhook) newCA(now time.Time) ([]byte, []byte, error) {
+	key, err := w.certOpts.generateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//nolint:exhaustruct
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName: fmt.Sprintf("mediastreamingmesh.%v-ca.%v", w.certOpts.serviceName, now.Unix()),
+		},
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              now.Add(w.certOpts.caValidity),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+
+	certRaw, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encodeCert(certRaw), keyPEM, nil
+}
+
+// issueServingCert signs a short-lived serving certificate for the webhook
+// Service with the CA
+func (w *MsmWebhook) issueServingCert(ca *x509.Certificate, caKey crypto.Signer, now time.Time) (*tls.Certificate, error) {
+	key, err := w.certOpts.generateKey()
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	notAfter := now.Add(w.certOpts.validity)
+	if notAfter.After(ca.NotAfter) {
+		notAfter = ca.NotAfter
+	}
+
+	//nolint:exhaustruct
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName: fmt.Sprintf("%v.%v.svc", w.certOpts.serviceName, w.namespace),
+		},
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:              w.certOpts.keyUsage(),
+		DNSNames: append([]string{
+			fmt.Sprintf("%v.%v", w.certOpts.serviceName, w.namespace),
+			fmt.Sprintf("%v.%v.svc", w.certOpts.serviceName, w.namespace),
+		}, w.certOpts.extraDNSNames...),
+		IPAddresses: w.certOpts.extraIPs,
+	}
+
+	certRaw, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(certRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	//nolint:exhaustruct
+	return &tls.Certificate{
+		Certificate: [][]byte{certRaw, ca.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// parseCA parses a CA certificate and its key from PEM
+func parseCA(certPEM, keyPEM []byte) (*x509.Certificate, crypto.Signer, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ca.IsCA {
+		return nil, nil, fmt.Errorf("certificate %v is not a CA", ca.Subject.CommonName)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, errNotSigner
+	}
+	return ca, key, nil
+}
+
+// parseCerts parses all the certificates of a PEM bundle
+func parseCerts(bundle []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	return certs, nil
+}
+
+func encodeCert(raw []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: raw,
+	})
+}
+
+func encodeKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: der,
+	}), nil
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
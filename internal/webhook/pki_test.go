@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"strings"
+	"testing"
+)
+
+// setCertEnv sets the certificate settings for the test
+func setCertEnv(t *testing.T, algorithm, validity, caValidity, sans string) {
+	t.Helper()
+	previous := []string{CertKeyAlgorithm, CertValidity, CAValidity, CertExtraSANs}
+	CertKeyAlgorithm, CertValidity, CAValidity, CertExtraSANs = algorithm, validity, caValidity, sans
+	t.Cleanup(func() {
+		CertKeyAlgorithm, CertValidity, CAValidity, CertExtraSANs = previous[0], previous[1], previous[2], previous[3]
+	})
+}
+
+func TestParseCertOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		mode       string
+		algorithm  string
+		validity   string
+		caValidity string
+		sans       string
+		wantErr    string
+	}{
+		{name: "defaults", mode: certModeSelfSigned},
+		{name: "defaults in file mode", mode: certModeFile},
+		{
+			name: "customized", mode: certModeSelfSigned, algorithm: "ECDSA-P256", validity: "24h", caValidity: "8760h",
+			sans: "webhook.example.com, *.msm.svc, 10.0.0.1",
+		},
+		{name: "unknown key algorithm", mode: certModeSelfSigned, algorithm: "dsa", wantErr: "unknown key algorithm"},
+		{name: "unparsable validity", mode: certModeSelfSigned, validity: "1 week", wantErr: "invalid certificate validity"},
+		{name: "unparsable CA validity", mode: certModeSelfSigned, caValidity: "10y", wantErr: "invalid CA validity"},
+		{name: "validity too short", mode: certModeSelfSigned, validity: "30m", wantErr: "shorter than"},
+		{
+			name: "validity beyond the CA renewal", mode: certModeSelfSigned, validity: "48h", caValidity: "240h",
+			wantErr: "tenth of the CA validity",
+		},
+		{name: "invalid SAN", mode: certModeSelfSigned, sans: "not a name", wantErr: "invalid SAN"},
+		{name: "key setting in file mode", mode: certModeFile, algorithm: "ed25519", wantErr: "only apply"},
+		{name: "validity in cert-manager mode", mode: certModeCertManager, validity: "24h", wantErr: "only apply"},
+		{name: "SAN in file mode", mode: certModeFile, sans: "10.0.0.1", wantErr: "only apply"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setCertEnv(t, tc.algorithm, tc.validity, tc.caValidity, tc.sans)
+			opts, err := parseCertOptions(tc.mode)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.validity >= opts.caRenewBefore() {
+				t.Errorf("validity %v is not shorter than the CA renewal %v", opts.validity, opts.caRenewBefore())
+			}
+		})
+	}
+}
+
+func TestParseCertOptionsSANs(t *testing.T) {
+	setCertEnv(t, keyAlgorithmECDSA, "", "", "webhook.example.com, *.msm.svc, 10.0.0.1, ::1")
+	opts, err := parseCertOptions(certModeSelfSigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(opts.extraDNSNames, ","); got != "webhook.example.com,*.msm.svc" {
+		t.Errorf("got DNS names %v", got)
+	}
+	if len(opts.extraIPs) != 2 {
+		t.Errorf("got IPs %v", opts.extraIPs)
+	}
+	if opts.keyAlgorithm != keyAlgorithmECDSA || opts.validity != servingValidity || opts.caValidity != caValidity {
+		t.Errorf("got %+v", opts)
+	}
+}
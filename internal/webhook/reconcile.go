@@ -0,0 +1,194 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+
+	admitv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// newEventRecorder records Events on behalf of the webhook
+//
+//nolint:exhaustruct
+func (w *MsmWebhook) newEventRecorder(ctx context.Context) record.EventRecorder {
+	broadcaster := record.NewBroadcaster(record.WithContext(ctx))
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: w.kube.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: fieldManager})
+}
+
+// reconcileWebhookConfigs watches the managed webhook configurations and
+// restores their caBundle, and the applied fields when self-registering, as
+// soon as something else changes them, e.g. a helm upgrade
+func (w *MsmWebhook) reconcileWebhookConfigs(ctx context.Context) {
+	factory := informers.NewSharedInformerFactory(w.kube, 0)
+
+	for _, kind := range w.managed.kinds() {
+		check := func(obj interface{}) {
+			config, ok := kind.wrap(obj)
+			if !ok || !kind.manages(config.meta) {
+				return
+			}
+			name := config.meta.GetName()
+			var drifted []string
+			if w.isApplied(kind, name) {
+				drifted = w.webhookConfigDrift(obj.(*admitv1.MutatingWebhookConfiguration)) //nolint:forcetypeassert
+			} else {
+				drifted = w.caBundleDrift(config)
+			}
+			if len(drifted) == 0 {
+				return
+			}
+			w.Log.Warnf("%v %v drifted (%v), restoring it", kind.kind, name, strings.Join(drifted, ", "))
+			webhookConfigDriftsTotal.WithLabelValues(name).Inc()
+			w.recorder.Eventf(config.object, corev1.EventTypeWarning, eventReasonDrift,
+				"Restoring drifted %v", strings.Join(drifted, ", "))
+			if err := w.restoreWebhookConfig(ctx, kind, name); err != nil {
+				w.Log.Errorf("Could not restore %v %v: %v", kind.kind, name, err)
+				reconcileErrorsTotal.WithLabelValues(kind.kind).Inc()
+			}
+		}
+
+		//nolint:exhaustruct
+		_, err := kind.informer(factory).AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    check,
+			UpdateFunc: func(_, obj interface{}) { check(obj) },
+			DeleteFunc: func(obj interface{}) {
+				if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+				config, ok := kind.wrap(obj)
+				if !ok || !kind.manages(config.meta) {
+					return
+				}
+				name := config.meta.GetName()
+				if !w.isApplied(kind, name) {
+					w.Log.Errorf("%v %v was deleted", kind.kind, name)
+					w.recorder.Eventf(config.object, corev1.EventTypeWarning, eventReasonDrift,
+						"Deleted, the caBundle can only be restored once it is recreated")
+					return
+				}
+				w.Log.Warnf("%v %v was deleted, restoring it", kind.kind, name)
+				webhookConfigDriftsTotal.WithLabelValues(name).Inc()
+				w.recorder.Eventf(config.object, corev1.EventTypeWarning, eventReasonDrift,
+					"Restoring the deleted configuration")
+				if err := w.restoreWebhookConfig(ctx, kind, name); err != nil {
+					w.Log.Errorf("Could not restore %v %v: %v", kind.kind, name, err)
+					reconcileErrorsTotal.WithLabelValues(kind.kind).Inc()
+				}
+			},
+		})
+		if err != nil {
+			w.Log.Errorf("Could not watch %v: %v", kind.kind, err)
+			return
+		}
+	}
+	factory.Start(ctx.Done())
+}
+
+func (w *MsmWebhook) restoreWebhookConfig(ctx context.Context, kind *webhookConfigKind, name string) error {
+	if w.isApplied(kind, name) {
+		return w.applyMutatingWebhookConfig(ctx, name)
+	}
+	return w.patchWebhookConfig(ctx, kind, name)
+}
+
+// caBundleDrift lists the webhooks pointing at our Service whose caBundle
+// differs from the served CA
+func (w *MsmWebhook) caBundleDrift(config *webhookConfig) []string {
+	if w.certMode == certModeCertManager {
+		return nil
+	}
+	var drifted []string
+	caBundle := w.getCABundle()
+	for _, wh := range w.owned(config) {
+		if !bytes.Equal(caBundle, wh.config.CABundle) {
+			drifted = append(drifted, wh.name+" caBundle")
+		}
+	}
+	return drifted
+}
+
+// webhookConfigDrift lists the fields of the applied configuration that
+// differ from what the webhook registered
+func (w *MsmWebhook) webhookConfigDrift(config *admitv1.MutatingWebhookConfiguration) []string {
+	var drifted []string
+	want := w.mutatingWebhook(config.Name, w.register)
+	var got *admitv1.MutatingWebhook
+	for i := range config.Webhooks {
+		if config.Webhooks[i].Name == *want.Name {
+			got = &config.Webhooks[i]
+		}
+	}
+	if got == nil {
+		return []string{*want.Name}
+	}
+
+	for _, f := range []struct {
+		name string
+		want interface{}
+		got  interface{}
+	}{
+		{name: "caBundle", want: want.ClientConfig.CABundle, got: got.ClientConfig.CABundle},
+		{name: "service", want: want.ClientConfig.Service, got: got.ClientConfig.Service},
+		{name: "rules", want: want.Rules, got: got.Rules},
+		{name: "failurePolicy", want: want.FailurePolicy, got: got.FailurePolicy},
+		{name: "timeoutSeconds", want: want.TimeoutSeconds, got: got.TimeoutSeconds},
+		{name: "sideEffects", want: want.SideEffects, got: got.SideEffects},
+		{name: "reinvocationPolicy", want: want.ReinvocationPolicy, got: got.ReinvocationPolicy},
+		{name: "namespaceSelector", want: want.NamespaceSelector, got: got.NamespaceSelector},
+		{name: "objectSelector", want: want.ObjectSelector, got: got.ObjectSelector},
+	} {
+		// fields left unset are not managed, e.g. the caBundle in
+		// cert-manager mode or the default selectors
+		if isUnset(f.want) {
+			continue
+		}
+		if !jsonEqual(f.want, f.got) {
+			drifted = append(drifted, *want.Name+" "+f.name)
+		}
+	}
+	return drifted
+}
+
+func isUnset(v interface{}) bool {
+	b, err := json.Marshal(v)
+	return err != nil || string(b) == "null"
+}
+
+// jsonEqual compares apply configurations and API objects by their
+// serialized form
+func jsonEqual(a, b interface{}) bool {
+	x, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	y, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(x, y)
+}
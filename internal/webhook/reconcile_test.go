@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	admitv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+//nolint:exhaustruct
+func TestWebhookConfigDrift(t *testing.T) {
+	WebhookRegistration = registrationApply
+	MsmWHConfigName = "msm-webhook"
+	WebhookNamespaceSelector = "kubernetes.io/metadata.name notin (msm)"
+	defer func() {
+		WebhookRegistration = ""
+		MsmWHConfigName = ""
+		WebhookNamespaceSelector = ""
+	}()
+
+	register, err := parseRegistrationOptions("msm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newTestWebhook()
+	w.register = register
+	w.namespace = "msm"
+	w.certMode = certModeSelfSigned
+	w.certOpts = &certOptions{serviceName: msmServiceName}
+	w.caBundle = []byte("ca")
+
+	// the API server view of the applied webhook, with defaulted fields
+	raw, err := json.Marshal(w.mutatingWebhook(MsmWHConfigName, w.register))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var applied admitv1.MutatingWebhook
+	if err := json.Unmarshal(raw, &applied); err != nil {
+		t.Fatal(err)
+	}
+	matchPolicy := admitv1.Equivalent
+	applied.MatchPolicy = &matchPolicy
+	applied.ObjectSelector = &metav1.LabelSelector{}
+
+	config := func(modify func(wh *admitv1.MutatingWebhook)) *admitv1.MutatingWebhookConfiguration {
+		wh := *applied.DeepCopy()
+		modify(&wh)
+		return &admitv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: MsmWHConfigName},
+			Webhooks:   []admitv1.MutatingWebhook{wh},
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func(wh *admitv1.MutatingWebhook)
+		want   []string
+	}{
+		{
+			name:   "unchanged",
+			modify: func(*admitv1.MutatingWebhook) {},
+			want:   nil,
+		},
+		{
+			name:   "caBundle reset",
+			modify: func(wh *admitv1.MutatingWebhook) { wh.ClientConfig.CABundle = nil },
+			want:   []string{"msm-webhook.mediastreamingmesh.io caBundle"},
+		},
+		{
+			name: "failure policy changed",
+			modify: func(wh *admitv1.MutatingWebhook) {
+				policy := admitv1.Ignore
+				wh.FailurePolicy = &policy
+			},
+			want: []string{"msm-webhook.mediastreamingmesh.io failurePolicy"},
+		},
+		{
+			name:   "namespace selector removed",
+			modify: func(wh *admitv1.MutatingWebhook) { wh.NamespaceSelector = &metav1.LabelSelector{} },
+			want:   []string{"msm-webhook.mediastreamingmesh.io namespaceSelector"},
+		},
+		{
+			name:   "webhook renamed",
+			modify: func(wh *admitv1.MutatingWebhook) { wh.Name = "other.mediastreamingmesh.io" },
+			want:   []string{"msm-webhook.mediastreamingmesh.io"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := w.webhookConfigDrift(config(tc.modify))
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("drift = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+//nolint:exhaustruct
+func TestReconcileDeletedWebhookConfig(t *testing.T) {
+	w, clientset := newRegistrationTestWebhook(&admitv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "msm-webhook"},
+		Webhooks: []admitv1.MutatingWebhook{{
+			Name:         "msm-webhook.mediastreamingmesh.io",
+			ClientConfig: admitv1.WebhookClientConfig{Service: ownService(), CABundle: []byte("stale")},
+		}},
+	})
+	w.certMode = certModeSelfSigned
+	recorder := record.NewFakeRecorder(10)
+	w.recorder = recorder
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w.reconcileWebhookConfigs(ctx)
+
+	nextEvent := func() string {
+		t.Helper()
+		select {
+		case event := <-recorder.Events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected an event")
+			return ""
+		}
+	}
+	if event := nextEvent(); !strings.Contains(event, eventReasonDrift) || !strings.Contains(event, "caBundle") {
+		t.Fatalf("expected a caBundle drift event, got %q", event)
+	}
+
+	err := clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().
+		Delete(ctx, "msm-webhook", metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(); !strings.Contains(event, eventReasonDrift) || !strings.Contains(event, "Deleted") {
+		t.Fatalf("expected a deletion drift event, got %q", event)
+	}
+}
@@ -0,0 +1,257 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	admitv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	admitv1ac "k8s.io/client-go/applyconfigurations/admissionregistration/v1"
+	metav1ac "k8s.io/client-go/applyconfigurations/meta/v1"
+)
+
+// registrationOptions describe the MutatingWebhookConfiguration the webhook
+// applies itself when self-registration is enabled
+type registrationOptions struct {
+	failurePolicy      admitv1.FailurePolicyType
+	timeoutSeconds     int32
+	sideEffects        admitv1.SideEffectClass
+	reinvocationPolicy admitv1.ReinvocationPolicyType
+	namespaceSelector  *metav1.LabelSelector
+	objectSelector     *metav1.LabelSelector
+}
+
+// parseRegistrationOptions validates the self-registration settings, it
+// returns nil when the webhook only patches the caBundle of an existing
+// configuration. The namespace selector excludes the webhook namespace by
+// default, so that the default Fail policy cannot lock out the webhook pods.
+func parseRegistrationOptions(namespace string) (*registrationOptions, error) {
+	switch WebhookRegistration {
+	case "", registrationPatch:
+		return nil, nil //nolint:nilnil
+	case registrationApply:
+	default:
+		return nil, fmt.Errorf("unknown webhook registration %v, expect %v or %v",
+			WebhookRegistration, registrationPatch, registrationApply)
+	}
+	if MsmWHConfigName == "" {
+		return nil, fmt.Errorf("webhook registration %v requires a webhook config name", registrationApply)
+	}
+
+	//nolint:exhaustruct
+	otherNamespaces := &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{{
+			Key:      corev1.LabelMetadataName,
+			Operator: metav1.LabelSelectorOpNotIn,
+			Values:   []string{namespace},
+		}},
+	}
+	opts := &registrationOptions{
+		failurePolicy:      admitv1.Fail,
+		timeoutSeconds:     defaultTimeoutSeconds,
+		sideEffects:        admitv1.SideEffectClassNoneOnDryRun,
+		reinvocationPolicy: admitv1.NeverReinvocationPolicy,
+		namespaceSelector:  otherNamespaces,
+		objectSelector:     nil,
+	}
+
+	switch p := admitv1.FailurePolicyType(WebhookFailurePolicy); p {
+	case "":
+	case admitv1.Fail, admitv1.Ignore:
+		opts.failurePolicy = p
+	default:
+		return nil, fmt.Errorf("invalid failure policy %v, expect %v or %v", p, admitv1.Fail, admitv1.Ignore)
+	}
+
+	if WebhookTimeoutSeconds != "" {
+		t, err := strconv.ParseInt(WebhookTimeoutSeconds, 10, 32)
+		if err != nil || t < 1 || t > 30 {
+			return nil, fmt.Errorf("invalid timeout %q, expect 1 to 30 seconds", WebhookTimeoutSeconds)
+		}
+		opts.timeoutSeconds = int32(t)
+	}
+
+	switch s := admitv1.SideEffectClass(WebhookSideEffects); s {
+	case "":
+	case admitv1.SideEffectClassNone, admitv1.SideEffectClassNoneOnDryRun:
+		opts.sideEffects = s
+	default:
+		return nil, fmt.Errorf("invalid side effects %v, expect %v or %v",
+			s, admitv1.SideEffectClassNone, admitv1.SideEffectClassNoneOnDryRun)
+	}
+
+	switch r := admitv1.ReinvocationPolicyType(WebhookReinvocationPolicy); r {
+	case "":
+	case admitv1.NeverReinvocationPolicy, admitv1.IfNeededReinvocationPolicy:
+		opts.reinvocationPolicy = r
+	default:
+		return nil, fmt.Errorf("invalid reinvocation policy %v, expect %v or %v",
+			r, admitv1.NeverReinvocationPolicy, admitv1.IfNeededReinvocationPolicy)
+	}
+
+	for _, s := range []struct {
+		name  string
+		value string
+		into  **metav1.LabelSelector
+	}{
+		{name: "namespace selector", value: WebhookNamespaceSelector, into: &opts.namespaceSelector},
+		{name: "object selector", value: WebhookObjectSelector, into: &opts.objectSelector},
+	} {
+		if s.value == "" {
+			continue
+		}
+		selector, err := metav1.ParseToLabelSelector(s.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v %q: %w", s.name, s.value, err)
+		}
+		*s.into = selector
+	}
+
+	return opts, nil
+}
+
+// applyMutatingWebhookConfig creates or updates the whole mutating webhook
+// configuration with server-side apply. Fields owned by other managers, such
+// as Helm labels or other webhooks, are left untouched, and a field another
+// manager set to a different value fails the registration rather than being
+// taken over.
+func (w *MsmWebhook) applyMutatingWebhookConfig(ctx context.Context, webhookConfigName string) error {
+	return w.applyMutatingWebhook(ctx, webhookConfigName, w.register)
+}
+
+func (w *MsmWebhook) applyMutatingWebhook(ctx context.Context, webhookConfigName string,
+	opts *registrationOptions,
+) error {
+	config := admitv1ac.MutatingWebhookConfiguration(webhookConfigName).
+		WithWebhooks(w.mutatingWebhook(webhookConfigName, opts))
+	err := w.retryRegistration(ctx, func() error {
+		_, err := w.client.MutatingWebhookConfigurations().Apply(ctx, config, metav1.ApplyOptions{
+			TypeMeta:     metav1.TypeMeta{},
+			DryRun:       nil,
+			Force:        false,
+			FieldManager: fieldManager,
+		})
+		if apierrors.IsConflict(err) {
+			return fmt.Errorf("%w: %v", errApplyConflict, err)
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not apply webhook config %v: %w", webhookConfigName, err)
+	}
+	w.Log.Infof("Applied webhook config %v", webhookConfigName)
+	return nil
+}
+
+// mutatingWebhook describes the fields of the webhook owned by this field manager
+func (w *MsmWebhook) mutatingWebhook(webhookConfigName string,
+	opts *registrationOptions,
+) *admitv1ac.MutatingWebhookApplyConfiguration {
+	clientConfig := admitv1ac.WebhookClientConfig().
+		WithService(admitv1ac.ServiceReference().
+			WithNamespace(w.namespace).
+			WithName(w.certOpts.serviceName).
+			WithPath(mutateMethod).
+			WithPort(defaultPort))
+	// in cert-manager mode the CA injector owns the caBundle
+	if w.certMode != certModeCertManager {
+		clientConfig = clientConfig.WithCABundle(w.getCABundle()...)
+	}
+
+	webhook := admitv1ac.MutatingWebhook().
+		WithName(mutatingWebhookName(webhookConfigName)).
+		WithClientConfig(clientConfig).
+		WithRules(
+			// pod containers are immutable, the stub is only injected on creation
+			admitv1ac.RuleWithOperations().
+				WithOperations(admitv1.Create).
+				WithAPIGroups("").
+				WithAPIVersions("v1").
+				WithResources("pods").
+				WithScope(admitv1.NamespacedScope),
+			admitv1ac.RuleWithOperations().
+				WithOperations(admitv1.Create, admitv1.Update).
+				WithAPIGroups("apps").
+				WithAPIVersions("v1").
+				WithResources("deployments", "statefulsets", "daemonsets").
+				WithScope(admitv1.NamespacedScope),
+		).
+		WithFailurePolicy(opts.failurePolicy).
+		WithTimeoutSeconds(opts.timeoutSeconds).
+		WithSideEffects(opts.sideEffects).
+		WithReinvocationPolicy(opts.reinvocationPolicy).
+		WithAdmissionReviewVersions("v1", "v1beta1")
+	if opts.namespaceSelector != nil {
+		webhook = webhook.WithNamespaceSelector(labelSelectorApplyConfig(opts.namespaceSelector))
+	}
+	if opts.objectSelector != nil {
+		webhook = webhook.WithObjectSelector(labelSelectorApplyConfig(opts.objectSelector))
+	}
+	return webhook
+}
+
+func mutatingWebhookName(webhookConfigName string) string {
+	return fmt.Sprintf("%v.%v", webhookConfigName, webhookNameSuffix)
+}
+
+func labelSelectorApplyConfig(selector *metav1.LabelSelector) *metav1ac.LabelSelectorApplyConfiguration {
+	ac := metav1ac.LabelSelector().WithMatchLabels(selector.MatchLabels)
+	for _, r := range selector.MatchExpressions {
+		ac = ac.WithMatchExpressions(metav1ac.LabelSelectorRequirement().
+			WithKey(r.Key).
+			WithOperator(r.Operator).
+			WithValues(r.Values...))
+	}
+	return ac
+}
+
+// checkFailurePolicy refuses to register a Fail webhook that also admits the
+// webhook's own pods, which would keep them from ever being recreated
+func (w *MsmWebhook) checkFailurePolicy(ctx context.Context) error {
+	if w.register.failurePolicy != admitv1.Fail {
+		return nil
+	}
+	if w.register.namespaceSelector == nil {
+		return fmt.Errorf("failure policy %v requires a namespace selector excluding namespace %v",
+			admitv1.Fail, w.namespace)
+	}
+
+	nsLabels := labels.Set{corev1.LabelMetadataName: w.namespace}
+	ns, err := w.kube.CoreV1().Namespaces().Get(ctx, w.namespace, metav1.GetOptions{}) //nolint:exhaustruct
+	if err != nil {
+		w.Log.Warnf("Could not get namespace %v, checking the namespace selector against its name only: %v",
+			w.namespace, err)
+	} else {
+		nsLabels = labels.Merge(nsLabels, ns.Labels)
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(w.register.namespaceSelector)
+	if err != nil {
+		return err
+	}
+	if selector.Matches(nsLabels) {
+		return fmt.Errorf("failure policy %v requires the namespace selector %v to exclude namespace %v",
+			admitv1.Fail, selector, w.namespace)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	admitv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+//nolint:exhaustruct
+func TestCheckFailurePolicy(t *testing.T) {
+	defer func() {
+		WebhookRegistration = ""
+		MsmWHConfigName = ""
+		WebhookFailurePolicy = ""
+		WebhookNamespaceSelector = ""
+	}()
+
+	for _, tc := range []struct {
+		name     string
+		policy   string
+		selector string
+		wantErr  bool
+	}{
+		{name: "fail with the default selector", policy: "Fail", selector: ""},
+		{name: "fail excluding own namespace", policy: "Fail", selector: "kubernetes.io/metadata.name notin (msm)"},
+		{name: "fail excluding by label", policy: "Fail", selector: "msm-webhook notin (disabled)", wantErr: true},
+		{name: "fail selecting other namespaces", policy: "Fail", selector: "media=enabled"},
+		{name: "ignore without selector", policy: "Ignore", selector: ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			WebhookRegistration = registrationApply
+			MsmWHConfigName = "msm-webhook"
+			WebhookFailurePolicy = tc.policy
+			WebhookNamespaceSelector = tc.selector
+
+			register, err := parseRegistrationOptions("msm")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := newTestWebhook()
+			w.register = register
+			w.namespace = "msm"
+			w.kube = fake.NewSimpleClientset(&corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{Name: "msm", Labels: map[string]string{"team": "media"}},
+			})
+
+			err = w.checkFailurePolicy(context.Background())
+			if (err != nil) != tc.wantErr {
+				t.Errorf("checkFailurePolicy() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+//nolint:exhaustruct
+func TestApplyMutatingWebhookConfigConflict(t *testing.T) {
+	w, clientset := newRegistrationTestWebhook()
+	w.register = &registrationOptions{failurePolicy: admitv1.Ignore}
+	w.certMode = certModeSelfSigned
+
+	applies := 0
+	clientset.PrependReactor("patch", "mutatingwebhookconfigurations",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			applies++
+			if patch, ok := action.(k8stesting.PatchAction); ok && patch.GetPatchType() != types.ApplyPatchType {
+				t.Errorf("got patch type %v, want server-side apply", patch.GetPatchType())
+			}
+			resource := schema.GroupResource{Group: "admissionregistration.k8s.io", Resource: "mutatingwebhookconfigurations"}
+			return true, nil, apierrors.NewConflict(resource, "msm-webhook",
+				errors.New(`Apply failed with 1 conflict: conflict with "helm": .webhooks[name="msm-webhook.mediastreamingmesh.io"].timeoutSeconds`))
+		})
+
+	err := w.applyMutatingWebhookConfig(context.Background(), "msm-webhook")
+	if !errors.Is(err, errApplyConflict) {
+		t.Fatalf("expected the conflict to be reported, got %v", err)
+	}
+	if applies != 1 {
+		t.Errorf("expected a conflict not to be retried, got %v attempts", applies)
+	}
+}
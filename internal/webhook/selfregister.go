@@ -19,133 +19,225 @@ package webhook
 import (
 	"bytes"
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
 	"errors"
 	"fmt"
-	"math/big"
-	"strings"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/util/retry"
 )
 
 var (
 	errNotFound          = errors.New("webhook config not found")
-	errNoWebhookWithName = errors.New("webhook name not found")
+	errNoWebhookWithName = errors.New("no webhook pointing at the webhook service")
+	errApplyConflict     = errors.New("fields are owned by another field manager")
 )
 
-func (w *MsmWebhook) selfSignedCert() tls.Certificate {
-	now := time.Now()
-
-	template := &x509.Certificate{
-		SerialNumber: big.NewInt(now.Unix()),
-		Subject: pkix.Name{
-			CommonName: fmt.Sprintf("mediastreamingmesh.%v-ca", msmServiceName),
-		},
-		NotBefore:             now,
-		NotAfter:              now.AddDate(1, 0, 0),
-		BasicConstraintsValid: true,
-		IsCA:                  true,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		KeyUsage: x509.KeyUsageKeyEncipherment |
-			x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
-		DNSNames: []string{
-			fmt.Sprintf("%v.%v", msmServiceName, w.namespace),
-			fmt.Sprintf("%v.%v.svc", msmServiceName, w.namespace),
-		},
+// patchWebhookConfigs patches the CA bundle of the managed webhook
+// configurations, and applies the whole mutating configuration first when
+// self-registration is enabled
+func (w *MsmWebhook) patchWebhookConfigs(ctx context.Context) error {
+	if w.register != nil {
+		if err := w.applyMutatingWebhookConfig(ctx, MsmWHConfigName); err != nil {
+			registrationErrorsTotal.WithLabelValues(mutatingKind).Inc()
+			return err
+		}
 	}
 
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		panic(err.Error())
+	var errs []error
+	for _, kind := range w.managed.kinds() {
+		names, err := kind.resolve(ctx)
+		if err != nil {
+			registrationErrorsTotal.WithLabelValues(kind.kind).Inc()
+			errs = append(errs, err)
+			continue
+		}
+		for _, name := range names {
+			if w.isApplied(kind, name) {
+				continue
+			}
+			if err := w.patchWebhookConfig(ctx, kind, name); err != nil {
+				registrationErrorsTotal.WithLabelValues(kind.kind).Inc()
+				errs = append(errs, err)
+			}
+		}
 	}
+	return errors.Join(errs...)
+}
 
-	certRaw, err := x509.CreateCertificate(rand.Reader, template, template, privateKey.Public(), privateKey)
-	if err != nil {
-		panic(err.Error())
-	}
+// patchWebhookConfig patches the CA bundle of the webhooks of the
+// configuration that point at our Service, and restores their failure policy
+// after a shutdown switched them to Ignore
+func (w *MsmWebhook) patchWebhookConfig(ctx context.Context, kind *webhookConfigKind, name string) error {
+	err := w.retryRegistration(ctx, func() error {
+		config, err := kind.get(ctx, name)
+		if err != nil {
+			return err
+		}
 
-	pemCert := pem.EncodeToMemory(&pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: certRaw,
-	})
+		owned := w.owned(config)
+		if len(owned) == 0 {
+			return errNoWebhookWithName
+		}
+		caBundle := w.getCABundle()
+		updated := restoreFailurePolicies(config, owned)
+		for _, wh := range owned {
+			if !bytes.Equal(caBundle, wh.config.CABundle) {
+				wh.config.CABundle = caBundle
+				updated = true
+			}
+		}
 
-	pemKey := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+		if updated {
+			return config.update(ctx)
+		}
+		return nil
 	})
-
-	result, err := tls.X509KeyPair(pemCert, pemKey)
-	if err != nil {
-		panic(err.Error())
-	}
-
-	w.caBundle = pemCert
-	return result
+	return registrationError(kind.kind, name, err)
 }
 
-// patchMutatingWebhookConfig takes a webhookConfigName and patches the CA bundle for that webhook configuration
-func (w *MsmWebhook) patchMutatingWebhookConfig(
-	ctx context.Context,
-	webhookConfigName string,
-) error {
-	opts := metav1.GetOptions{
-		TypeMeta:        metav1.TypeMeta{},
-		ResourceVersion: "",
-	}
+// isApplied tells whether the configuration is applied as a whole rather
+// than only patched
+func (w *MsmWebhook) isApplied(kind *webhookConfigKind, name string) bool {
+	return w.register != nil && kind.kind == mutatingKind && name == MsmWHConfigName
+}
 
-	/*
-		var config *admitv1.MutatingWebhookConfiguration
-		config, err := w.client.MutatingWebhookConfigurations().Get(ctx, webhookConfigName, opts)
-		if err != nil {
-			return err
+// retryRegistration runs op until it succeeds, the registration backoff is
+// exhausted or ctx is done. A conflicting update is retried right away
+// against a fresh read, errors that another attempt cannot fix, such as a
+// forbidden request, are returned immediately.
+func (w *MsmWebhook) retryRegistration(ctx context.Context, op func() error) error {
+	return backoff.Retry(func() error {
+		err := retry.RetryOnConflict(retry.DefaultRetry, op)
+		if err != nil && !isRetriable(err) {
+			return backoff.Permanent(err)
 		}
+		return err
+	}, backoff.WithContext(w.registrationBackoff.newBackOff(), ctx))
+}
 
-	*/
+// isRetriable tells whether a registration error may go away on its own: the
+// config may not be created yet, or the API server may be unreachable
+func isRetriable(err error) bool {
+	if errors.Is(err, errNoWebhookWithName) || errors.Is(err, errApplyConflict) {
+		return false
+	}
+	var status apierrors.APIStatus
+	if !errors.As(err, &status) {
+		return true
+	}
+	return apierrors.IsNotFound(err) ||
+		apierrors.IsConflict(err) ||
+		apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		apierrors.IsInternalError(err) ||
+		apierrors.IsUnexpectedServerError(err)
+}
 
-	// Add a backoff in case the config isn't there yet.
-	op := func() error {
-		_, err := w.client.MutatingWebhookConfigurations().Get(ctx, webhookConfigName, opts)
-		return err
+// registrationError keeps the API error, so that callers can still tell a
+// forbidden request from a missing config
+func registrationError(kind, webhookConfigName string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case apierrors.IsNotFound(err):
+		return fmt.Errorf("%w: %v %v: %w", errNotFound, kind, webhookConfigName, err)
+	case errors.Is(err, errNoWebhookWithName):
+		return fmt.Errorf("%v %v: %w", kind, webhookConfigName, err)
+	default:
+		return fmt.Errorf("could not patch %v %v: %w", kind, webhookConfigName, err)
 	}
-	err := backoff.Retry(op, backoff.NewExponentialBackOff())
+}
+
+// checkCABundles warns when the webhook configurations, whose caBundle is
+// injected by cert-manager, do not trust the served certificate
+func (w *MsmWebhook) checkCABundles(ctx context.Context) {
+	cert, err := w.getCertificate(nil)
 	if err != nil {
-		return errNotFound
-	}
-	// TODO this could be done more efficiently to avoid this additional lookup
-	config, err := w.client.MutatingWebhookConfigurations().Get(ctx, webhookConfigName, opts)
-	if err != nil || config == nil {
-		return errNotFound
+		w.Log.Warnf("Could not check the webhook caBundles: %v", err)
+		return
 	}
 
-	found := false
-	updated := false
-	// caCertPem, err := util.LoadCABundle(w.CABundleWatcher)
-	for i, wh := range config.Webhooks {
-		if strings.HasPrefix(wh.Name, webhookConfigName) {
-			if !bytes.Equal(w.caBundle, config.Webhooks[i].ClientConfig.CABundle) {
-				updated = true
+	for _, kind := range w.managed.kinds() {
+		names, err := kind.resolve(ctx)
+		if err != nil {
+			w.Log.Warnf("Could not check the caBundles: %v", err)
+			continue
+		}
+		for _, name := range names {
+			config, err := kind.get(ctx, name)
+			if err != nil {
+				w.Log.Warnf("Could not check the caBundle of %v %v: %v", kind.kind, name, err)
+				continue
+			}
+			bundles := make(map[string][]byte)
+			for _, wh := range w.owned(config) {
+				bundles[wh.name] = wh.config.CABundle
 			}
-			config.Webhooks[i].ClientConfig.CABundle = w.caBundle
-			found = true
+			w.checkCABundle(cert, name, config.meta.GetAnnotations(), bundles)
 		}
 	}
-	if !found {
-		return errNoWebhookWithName
+}
+
+func (w *MsmWebhook) checkCABundle(cert *tls.Certificate, configName string,
+	annotations map[string]string, bundles map[string][]byte,
+) {
+	if _, ok := annotations[certManagerInjectAnnotation]; !ok {
+		w.Log.Warnf("Webhook config %v has no %v annotation, its caBundle is not managed by cert-manager",
+			configName, certManagerInjectAnnotation)
 	}
+	if len(bundles) == 0 {
+		w.Log.Warnf("Webhook config %v: %v", configName, errNoWebhookWithName)
+	}
+	for name, caBundle := range bundles {
+		if err := verifyCABundle(caBundle, cert); err != nil {
+			w.Log.Warnf("caBundle of webhook %v in %v does not match the served certificate: %v",
+				name, configName, err)
+		}
+	}
+}
 
-	if updated {
-		_, err := w.client.MutatingWebhookConfigurations().Update(ctx, config, metav1.UpdateOptions{})
+// backoffOptions bound the retries of the webhook registration
+type backoffOptions struct {
+	maxElapsedTime time.Duration
+	maxInterval    time.Duration
+}
+
+func parseBackoffOptions() (*backoffOptions, error) {
+	opts := &backoffOptions{
+		maxElapsedTime: registrationTimeout,
+		maxInterval:    registrationMaxInterval,
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		into  *time.Duration
+	}{
+		{name: "registration timeout", value: RegistrationTimeout, into: &opts.maxElapsedTime},
+		{name: "registration max interval", value: RegistrationMaxInterval, into: &opts.maxInterval},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("invalid %v %q: %w", d.name, d.value, err)
+		}
+		if v <= 0 {
+			return nil, fmt.Errorf("invalid %v %v, expect a positive duration", d.name, v)
 		}
+		*d.into = v
 	}
+	return opts, nil
+}
 
-	return nil
+func (o *backoffOptions) newBackOff() backoff.BackOff {
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = o.maxElapsedTime
+	b.MaxInterval = o.maxInterval
+	return b
 }
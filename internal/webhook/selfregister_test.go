@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	admitv1 "k8s.io/api/admissionregistration/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+//nolint:exhaustruct
+func newRegistrationTestWebhook(objects ...runtime.Object) (*MsmWebhook, *fake.Clientset) {
+	clientset := fake.NewSimpleClientset(objects...)
+	w := newTestWebhook()
+	w.kube = clientset
+	w.client = clientset.AdmissionregistrationV1()
+	w.namespace = "msm"
+	w.certOpts = &certOptions{serviceName: msmServiceName}
+	w.managed = &managedConfigs{
+		mutating:   &webhookConfigKind{kind: mutatingKind, names: []string{"msm-webhook"}},
+		validating: &webhookConfigKind{kind: validatingKind},
+	}
+	w.bindConfigKinds()
+	w.caBundle = []byte("ca")
+	w.registrationBackoff = &backoffOptions{maxElapsedTime: time.Second, maxInterval: 10 * time.Millisecond}
+	return w, clientset
+}
+
+//nolint:exhaustruct
+func ownService() *admitv1.ServiceReference {
+	return &admitv1.ServiceReference{Namespace: "msm", Name: msmServiceName}
+}
+
+//nolint:exhaustruct
+func TestPatchWebhookConfig(t *testing.T) {
+	resource := schema.GroupResource{Group: "admissionregistration.k8s.io", Resource: "mutatingwebhookconfigurations"}
+	config := &admitv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "msm-webhook"},
+		Webhooks: []admitv1.MutatingWebhook{{
+			Name:         "msm-webhook.mediastreamingmesh.io",
+			ClientConfig: admitv1.WebhookClientConfig{Service: ownService()},
+		}},
+	}
+
+	t.Run("conflict is retried on a fresh read", func(t *testing.T) {
+		w, clientset := newRegistrationTestWebhook(config.DeepCopy())
+		conflicts := 0
+		clientset.PrependReactor("update", "mutatingwebhookconfigurations",
+			func(k8stesting.Action) (bool, runtime.Object, error) {
+				if conflicts++; conflicts == 1 {
+					return true, nil, apierrors.NewConflict(resource, "msm-webhook", errors.New("stale"))
+				}
+				return false, nil, nil
+			})
+
+		if err := w.patchWebhookConfig(context.Background(), w.managed.mutating, "msm-webhook"); err != nil {
+			t.Fatal(err)
+		}
+		got, err := w.client.MutatingWebhookConfigurations().Get(context.Background(), "msm-webhook", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got.Webhooks[0].ClientConfig.CABundle) != "ca" {
+			t.Errorf("caBundle = %q, want %q", got.Webhooks[0].ClientConfig.CABundle, "ca")
+		}
+	})
+
+	t.Run("forbidden is not retried", func(t *testing.T) {
+		w, clientset := newRegistrationTestWebhook(config.DeepCopy())
+		gets := 0
+		clientset.PrependReactor("get", "mutatingwebhookconfigurations",
+			func(k8stesting.Action) (bool, runtime.Object, error) {
+				gets++
+				return true, nil, apierrors.NewForbidden(resource, "msm-webhook", errors.New("rbac"))
+			})
+
+		err := w.patchWebhookConfig(context.Background(), w.managed.mutating, "msm-webhook")
+		if !apierrors.IsForbidden(err) {
+			t.Errorf("error = %v, want forbidden", err)
+		}
+		if gets != 1 {
+			t.Errorf("got %d attempts, want 1", gets)
+		}
+	})
+
+	t.Run("missing config is bounded", func(t *testing.T) {
+		w, _ := newRegistrationTestWebhook()
+		err := w.patchWebhookConfig(context.Background(), w.managed.mutating, "msm-webhook")
+		if !errors.Is(err, errNotFound) || !apierrors.IsNotFound(err) {
+			t.Errorf("error = %v, want not found", err)
+		}
+	})
+
+	t.Run("cancelled context stops retries", func(t *testing.T) {
+		w, _ := newRegistrationTestWebhook()
+		w.registrationBackoff.maxElapsedTime = time.Hour
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		if err := w.patchWebhookConfig(ctx, w.managed.mutating, "msm-webhook"); err == nil {
+			t.Error("expected an error")
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("registration took %v after cancellation", elapsed)
+		}
+	})
+}
+
+//nolint:exhaustruct
+func TestPatchWebhookConfigs(t *testing.T) {
+	other := &admitv1.ServiceReference{Namespace: "msm", Name: "other-svc"}
+	w, _ := newRegistrationTestWebhook(
+		&admitv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "msm-webhook"},
+			Webhooks: []admitv1.MutatingWebhook{
+				{Name: "inject.mediastreamingmesh.io", ClientConfig: admitv1.WebhookClientConfig{Service: ownService()}},
+				{Name: "msm-webhook.other.io", ClientConfig: admitv1.WebhookClientConfig{Service: other}},
+			},
+		},
+		&admitv1.ValidatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "companion", Labels: map[string]string{"msm-ca": "managed"}},
+			Webhooks: []admitv1.ValidatingWebhook{
+				{Name: "validate.mediastreamingmesh.io", ClientConfig: admitv1.WebhookClientConfig{Service: ownService()}},
+			},
+		},
+		&admitv1.ValidatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "unmanaged"},
+			Webhooks: []admitv1.ValidatingWebhook{
+				{Name: "validate.mediastreamingmesh.io", ClientConfig: admitv1.WebhookClientConfig{Service: ownService()}},
+			},
+		},
+	)
+	selector, err := labels.Parse("msm-ca=managed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.managed.validating.selector = selector
+
+	ctx := context.Background()
+	if err := w.patchWebhookConfigs(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	mutating, err := w.client.MutatingWebhookConfigurations().Get(ctx, "msm-webhook", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(mutating.Webhooks[0].ClientConfig.CABundle); got != "ca" {
+		t.Errorf("own webhook caBundle = %q, want %q", got, "ca")
+	}
+	if got := mutating.Webhooks[1].ClientConfig.CABundle; got != nil {
+		t.Errorf("webhook of another service caBundle = %q, want none", got)
+	}
+
+	for name, want := range map[string]string{"companion": "ca", "unmanaged": ""} {
+		validating, err := w.client.ValidatingWebhookConfigurations().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(validating.Webhooks[0].ClientConfig.CABundle); got != want {
+			t.Errorf("%v caBundle = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	admitv1 "k8s.io/api/admissionregistration/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// parseShutdownPolicy validates what the last replica does to the mutating
+// webhook configuration when shutting down
+func parseShutdownPolicy(register *registrationOptions) (string, error) {
+	switch WebhookShutdownPolicy {
+	case "", shutdownPolicyNone:
+		return shutdownPolicyNone, nil
+	case shutdownPolicyIgnore, shutdownPolicyDelete:
+		// only a self-registered configuration gets its failure policy back,
+		// or comes back at all, on the next start
+		if register == nil {
+			return "", fmt.Errorf("shutdown policy %v requires the %v webhook registration",
+				WebhookShutdownPolicy, registrationApply)
+		}
+		return WebhookShutdownPolicy, nil
+	default:
+		return "", fmt.Errorf("unknown shutdown policy %v, expect one of %v, %v, %v",
+			WebhookShutdownPolicy, shutdownPolicyNone, shutdownPolicyIgnore, shutdownPolicyDelete)
+	}
+}
+
+// deregister applies the shutdown policy when no other replica is left to
+// serve admission requests, so that a scaled down or badly uninstalled
+// webhook cannot block the creation of labelled pods. The applied
+// configuration gets the policy, the other managed configurations only have
+// their webhooks switched to Ignore until the next start patches them again.
+func (w *MsmWebhook) deregister(ctx context.Context) {
+	if w.shutdownPolicy == shutdownPolicyNone || w.kube == nil {
+		return
+	}
+
+	last, err := w.isLastReplica(ctx)
+	if err != nil {
+		w.Log.Errorf("Could not check for other replicas, keeping the webhook configs: %v", err)
+		return
+	}
+	if !last {
+		w.Log.Infof("Other replicas are serving, keeping the webhook configs")
+		return
+	}
+
+	for _, kind := range w.managed.kinds() {
+		names, err := kind.resolve(ctx)
+		if err != nil {
+			w.Log.Errorf("Could not apply shutdown policy %v: %v", w.shutdownPolicy, err)
+			continue
+		}
+		for _, name := range names {
+			if !w.isApplied(kind, name) && w.certMode == certModeCertManager {
+				// nothing patches it back on the next start
+				continue
+			}
+			if err := w.deregisterWebhookConfig(ctx, kind, name); err != nil {
+				w.Log.Errorf("Could not apply shutdown policy %v to %v %v: %v",
+					w.shutdownPolicy, kind.kind, name, err)
+				continue
+			}
+			w.Log.Infof("Last replica shutting down, applied shutdown policy %v to %v %v",
+				w.shutdownPolicy, kind.kind, name)
+		}
+	}
+}
+
+func (w *MsmWebhook) deregisterWebhookConfig(ctx context.Context, kind *webhookConfigKind, name string) error {
+	switch {
+	case w.isApplied(kind, name) && w.shutdownPolicy == shutdownPolicyDelete:
+		return w.client.MutatingWebhookConfigurations().Delete(ctx, name, metav1.DeleteOptions{}) //nolint:exhaustruct
+	case w.isApplied(kind, name):
+		return w.ignoreFailures(ctx, name)
+	default:
+		return w.ignorePatchedFailures(ctx, kind, name)
+	}
+}
+
+// isLastReplica reports whether no other pod is ready behind the webhook Service
+func (w *MsmWebhook) isLastReplica(ctx context.Context) (bool, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return false, err
+	}
+
+	selector := labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: w.certOpts.serviceName})
+	slices, err := w.kube.DiscoveryV1().EndpointSlices(w.namespace).List(ctx, metav1.ListOptions{ //nolint:exhaustruct
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, slice := range slices.Items {
+		for _, e := range slice.Endpoints {
+			if e.Conditions.Ready == nil || !*e.Conditions.Ready {
+				continue
+			}
+			if e.TargetRef == nil || e.TargetRef.Name != hostname {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// ignoreFailures switches the applied webhook to the Ignore failure policy.
+// It is applied by the same field manager, so that the next start takes the
+// configured policy back without a conflict.
+func (w *MsmWebhook) ignoreFailures(ctx context.Context, webhookConfigName string) error {
+	opts := *w.register
+	opts.failurePolicy = admitv1.Ignore
+	return w.applyMutatingWebhook(ctx, webhookConfigName, &opts)
+}
+
+// ignorePatchedFailures switches the webhooks of a patched configuration
+// pointing at our Service to the Ignore failure policy, and keeps their
+// previous policy in an annotation for patchWebhookConfig to restore
+func (w *MsmWebhook) ignorePatchedFailures(ctx context.Context, kind *webhookConfigKind, name string) error {
+	err := w.retryRegistration(ctx, func() error {
+		config, err := kind.get(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		owned := w.owned(config)
+		if len(owned) == 0 {
+			return errNoWebhookWithName
+		}
+		previous := make(map[string]admitv1.FailurePolicyType)
+		if err := json.Unmarshal([]byte(config.meta.GetAnnotations()[failurePoliciesAnnotation]), &previous); err != nil {
+			previous = make(map[string]admitv1.FailurePolicyType)
+		}
+		ignore := admitv1.Ignore
+		for _, wh := range owned {
+			if _, ok := previous[wh.name]; !ok {
+				// the API server defaults an unset policy to Fail
+				previous[wh.name] = admitv1.Fail
+				if *wh.failurePolicy != nil {
+					previous[wh.name] = **wh.failurePolicy
+				}
+			}
+			*wh.failurePolicy = &ignore
+		}
+
+		raw, err := json.Marshal(previous)
+		if err != nil {
+			return err
+		}
+		annotations := config.meta.GetAnnotations()
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		annotations[failurePoliciesAnnotation] = string(raw)
+		config.meta.SetAnnotations(annotations)
+		return config.update(ctx)
+	})
+	return registrationError(kind.kind, name, err)
+}
+
+// restoreFailurePolicies restores the failure policies the shutdown policy
+// switched to Ignore, and tells whether the configuration changed
+func restoreFailurePolicies(config *webhookConfig, owned []webhookClientConfig) bool {
+	annotations := config.meta.GetAnnotations()
+	value, ok := annotations[failurePoliciesAnnotation]
+	if !ok {
+		return false
+	}
+	var previous map[string]admitv1.FailurePolicyType
+	if err := json.Unmarshal([]byte(value), &previous); err == nil {
+		for _, wh := range owned {
+			if policy, ok := previous[wh.name]; ok {
+				*wh.failurePolicy = &policy
+			}
+		}
+	}
+	delete(annotations, failurePoliciesAnnotation)
+	config.meta.SetAnnotations(annotations)
+	return true
+}
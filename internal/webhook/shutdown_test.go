@@ -0,0 +1,193 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"context"
+	"os"
+	"slices"
+	"testing"
+
+	admitv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestParseShutdownPolicy(t *testing.T) {
+	defer func() { WebhookShutdownPolicy = "" }()
+
+	for _, tc := range []struct {
+		name     string
+		policy   string
+		register *registrationOptions
+		want     string
+		wantErr  bool
+	}{
+		{name: "default", want: shutdownPolicyNone},
+		{name: "ignore when applied", policy: shutdownPolicyIgnore, register: &registrationOptions{}, want: shutdownPolicyIgnore},
+		{name: "ignore when patched", policy: shutdownPolicyIgnore, wantErr: true},
+		{name: "delete when applied", policy: shutdownPolicyDelete, register: &registrationOptions{}, want: shutdownPolicyDelete},
+		{name: "delete when patched", policy: shutdownPolicyDelete, wantErr: true},
+		{name: "unknown", policy: "drain", register: &registrationOptions{}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			WebhookShutdownPolicy = tc.policy
+			got, err := parseShutdownPolicy(tc.register)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("got policy %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+//nolint:exhaustruct
+func TestIsLastReplica(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ready, notReady := true, false
+	endpoint := func(pod string, ready *bool) discoveryv1.Endpoint {
+		e := discoveryv1.Endpoint{Conditions: discoveryv1.EndpointConditions{Ready: ready}}
+		if pod != "" {
+			e.TargetRef = &corev1.ObjectReference{Kind: "Pod", Name: pod}
+		}
+		return e
+	}
+	slice := func(service string, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+		return &discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      service,
+				Namespace: "msm",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: service},
+			},
+			Endpoints: endpoints,
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		slices []runtime.Object
+		want   bool
+	}{
+		{name: "no endpoints", want: true},
+		{name: "only this pod", slices: []runtime.Object{slice(msmServiceName, endpoint(hostname, &ready))}, want: true},
+		{
+			name:   "another ready pod",
+			slices: []runtime.Object{slice(msmServiceName, endpoint(hostname, &ready), endpoint("msm-webhook-2", &ready))},
+			want:   false,
+		},
+		{
+			name:   "another pod not ready",
+			slices: []runtime.Object{slice(msmServiceName, endpoint(hostname, &ready), endpoint("msm-webhook-2", &notReady))},
+			want:   true,
+		},
+		{
+			name:   "another pod with unknown readiness",
+			slices: []runtime.Object{slice(msmServiceName, endpoint(hostname, &ready), endpoint("msm-webhook-2", nil))},
+			want:   true,
+		},
+		{
+			name:   "ready endpoint without pod",
+			slices: []runtime.Object{slice(msmServiceName, endpoint(hostname, &ready), endpoint("", &ready))},
+			want:   false,
+		},
+		{
+			name:   "pod of another service",
+			slices: []runtime.Object{slice("other", endpoint("other-1", &ready)), slice(msmServiceName, endpoint(hostname, &ready))},
+			want:   true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w, _ := newRegistrationTestWebhook(tc.slices...)
+			got, err := w.isLastReplica(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+//nolint:exhaustruct
+func TestDeregisterPatchedConfigs(t *testing.T) {
+	fail, ignore := admitv1.Fail, admitv1.Ignore
+	other := &admitv1.ServiceReference{Namespace: "other", Name: "other-webhook"}
+	mutating := &admitv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "msm-webhook"},
+		Webhooks: []admitv1.MutatingWebhook{
+			{Name: "msm.mediastreamingmesh.io", ClientConfig: admitv1.WebhookClientConfig{Service: ownService(), CABundle: []byte("ca")}},
+			{Name: "other.example.com", ClientConfig: admitv1.WebhookClientConfig{Service: other}, FailurePolicy: &fail},
+		},
+	}
+	validating := &admitv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "msm-validating"},
+		Webhooks: []admitv1.ValidatingWebhook{
+			{Name: "msm.mediastreamingmesh.io", ClientConfig: admitv1.WebhookClientConfig{Service: ownService(), CABundle: []byte("ca")}, FailurePolicy: &ignore},
+		},
+	}
+	w, clientset := newRegistrationTestWebhook(mutating, validating)
+	w.managed.validating.names = []string{"msm-validating"}
+	w.certMode = certModeSelfSigned
+	w.shutdownPolicy = shutdownPolicyIgnore
+
+	policies := func() []admitv1.FailurePolicyType {
+		t.Helper()
+		ctx := context.Background()
+		m, err := clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, "msm-webhook", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := clientset.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, "msm-validating", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []admitv1.FailurePolicyType
+		for _, p := range []*admitv1.FailurePolicyType{m.Webhooks[0].FailurePolicy, m.Webhooks[1].FailurePolicy, v.Webhooks[0].FailurePolicy} {
+			if p == nil {
+				got = append(got, "")
+			} else {
+				got = append(got, *p)
+			}
+		}
+		return got
+	}
+
+	w.deregister(context.Background())
+	if got := policies(); !slices.Equal(got, []admitv1.FailurePolicyType{admitv1.Ignore, admitv1.Fail, admitv1.Ignore}) {
+		t.Fatalf("expected only the webhooks of our Service to ignore failures, got %v", got)
+	}
+
+	// the next start restores them, an unset policy comes back as the Fail default
+	if err := w.patchWebhookConfigs(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := policies(); !slices.Equal(got, []admitv1.FailurePolicyType{admitv1.Fail, admitv1.Fail, admitv1.Ignore}) {
+		t.Fatalf("expected the failure policies to be restored, got %v", got)
+	}
+	config, _ := clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.Background(), "msm-webhook", metav1.GetOptions{})
+	if _, ok := config.Annotations[failurePoliciesAnnotation]; ok {
+		t.Error("expected the annotation to be removed")
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"context"
+
+	v1 "k8s.io/api/admission/v1"
+)
+
+// admissionContext carries the state of a single admission request
+type admissionContext struct {
+	ctx      context.Context //nolint:containedctx
+	config   *Config
+	request  *v1.AdmissionRequest
+	dryRun   bool
+	skipped  int
+	injected bool
+
+	// audit details of the decision
+	decision    string
+	rule        string
+	stubImage   string
+	sidecarHash string
+}
+
+func newAdmissionContext(ctx context.Context, config *Config, request *v1.AdmissionRequest) *admissionContext {
+	return &admissionContext{
+		ctx:      ctx,
+		config:   config,
+		request:  request,
+		dryRun:   request.DryRun != nil && *request.DryRun,
+		skipped:  0,
+		injected: false,
+
+		decision:    "",
+		rule:        "",
+		stubImage:   "",
+		sidecarHash: "",
+	}
+}
+
+// decide records the decision and the rule that matched it, the first
+// decision of a request wins
+func (a *admissionContext) decide(decision, rule string) {
+	if a.decision != "" {
+		return
+	}
+	a.decision = decision
+	a.rule = rule
+}
+
+// auditAnnotations describes the decision in the API server audit log, the
+// keys are prefixed with the webhook name by the API server
+func (a *admissionContext) auditAnnotations() map[string]string {
+	if a.decision == "" {
+		return nil
+	}
+	annotations := map[string]string{
+		auditDecisionKey: a.decision,
+		auditRuleKey:     a.rule,
+	}
+	if a.stubImage != "" {
+		annotations[auditStubImageKey] = a.stubImage
+	}
+	if a.sidecarHash != "" {
+		annotations[auditSidecarHashKey] = a.sidecarHash
+	}
+	return annotations
+}
+
+// sideEffect is the single gate for everything an admission request causes
+// outside of its response: events, decision logs and generated resources.
+// On dry runs fn is skipped, which is what allows the webhook configuration
+// to declare sideEffects: NoneOnDryRun.
+func (a *admissionContext) sideEffect(fn func()) {
+	if a.dryRun {
+		a.skipped++
+		return
+	}
+	fn()
+}
+
+// logDecision logs an admission decision through the side effect gate
+func (w *MsmWebhook) logDecision(a *admissionContext, format string, args ...interface{}) {
+	a.sideEffect(func() {
+		w.Log.Infof(format, args...)
+	})
+}
+
+// finish reports the side effects skipped for a dry run
+func (w *MsmWebhook) finish(a *admissionContext) {
+	if a.dryRun {
+		w.Log.Debugf("Dry run for request UID %s, skipped %d side effects", a.request.UID, a.skipped)
+	}
+}
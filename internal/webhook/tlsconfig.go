@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// tlsConfig builds the TLS configuration of the webhook server. When a
+// client CA is configured, only clients presenting a certificate signed by
+// it, i.e. the API server, can send admission requests.
+//
+//nolint:exhaustruct
+func (w *MsmWebhook) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		GetCertificate: w.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	switch TLSMinVersion {
+	case "", "1.2":
+	case "1.3":
+		config.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("invalid TLS minimum version %v, expect 1.2 or 1.3", TLSMinVersion)
+	}
+
+	if TLSCipherSuites != "" {
+		if config.MinVersion == tls.VersionTLS13 {
+			return nil, fmt.Errorf("TLS cipher suites cannot be configured with TLS 1.3, which has a fixed set")
+		}
+		suites, err := parseCipherSuites(TLSCipherSuites)
+		if err != nil {
+			return nil, err
+		}
+		config.CipherSuites = suites
+	}
+
+	if ClientCAFile != "" {
+		caBundle, err := os.ReadFile(ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no certificate found in client CA file %v", ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		w.Log.Infof("Requiring client certificates signed by %v", ClientCAFile)
+	}
+
+	return config, nil
+}
+
+// parseCipherSuites resolves the names of secure TLS 1.2 cipher suites
+func parseCipherSuites(names string) ([]uint16, error) {
+	secure := make(map[string]uint16)
+	tls13 := make(map[string]bool)
+	for _, s := range tls.CipherSuites() {
+		// TLS 1.3 suites are not configurable, crypto/tls ignores them in
+		// CipherSuites
+		if !slices.Contains(s.SupportedVersions, tls.VersionTLS12) {
+			tls13[s.Name] = true
+			continue
+		}
+		secure[s.Name] = s.ID
+	}
+
+	var result []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if tls13[name] {
+			return nil, fmt.Errorf("TLS cipher suite %v is TLS 1.3 only and cannot be configured", name)
+		}
+		id, ok := secure[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure TLS cipher suite %v", name)
+		}
+		result = append(result, id)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no TLS cipher suite in %q", names)
+	}
+	return result, nil
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"crypto/tls"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// setTLSEnv sets the TLS settings for the test
+func setTLSEnv(t *testing.T, minVersion, cipherSuites string) {
+	t.Helper()
+	previousVersion, previousSuites := TLSMinVersion, TLSCipherSuites
+	TLSMinVersion, TLSCipherSuites = minVersion, cipherSuites
+	t.Cleanup(func() { TLSMinVersion, TLSCipherSuites = previousVersion, previousSuites })
+}
+
+func TestTLSConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		minVersion   string
+		cipherSuites string
+		wantVersion  uint16
+		wantSuites   []uint16
+		wantErr      string
+	}{
+		{name: "defaults", wantVersion: tls.VersionTLS12},
+		{name: "TLS 1.3", minVersion: "1.3", wantVersion: tls.VersionTLS13},
+		{
+			name: "secure suites", cipherSuites: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+			wantVersion: tls.VersionTLS12,
+			wantSuites:  []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+		},
+		{name: "unknown version", minVersion: "1.1", wantErr: "invalid TLS minimum version"},
+		{
+			name: "TLS 1.3 with cipher suites", minVersion: "1.3", cipherSuites: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+			wantErr: "cannot be configured with TLS 1.3",
+		},
+		{name: "insecure suite", cipherSuites: "TLS_RSA_WITH_RC4_128_SHA", wantErr: "insecure TLS cipher suite"},
+		{
+			name: "insecure suite among secure ones", cipherSuites: "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,TLS_RSA_WITH_3DES_EDE_CBC_SHA",
+			wantErr: "insecure TLS cipher suite",
+		},
+		{
+			name: "TLS 1.3 suite", cipherSuites: "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,TLS_AES_128_GCM_SHA256",
+			wantErr: "TLS_AES_128_GCM_SHA256 is TLS 1.3 only",
+		},
+		{name: "unknown suite", cipherSuites: "TLS_NOT_A_SUITE", wantErr: "unknown or insecure"},
+		{name: "empty suite list", cipherSuites: " , ", wantErr: "no TLS cipher suite"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setTLSEnv(t, tc.minVersion, tc.cipherSuites)
+			config, err := newTestWebhook().tlsConfig()
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.MinVersion != tc.wantVersion {
+				t.Errorf("got minimum version %x, want %x", config.MinVersion, tc.wantVersion)
+			}
+			if !slices.Equal(config.CipherSuites, tc.wantSuites) {
+				t.Errorf("got cipher suites %v, want %v", config.CipherSuites, tc.wantSuites)
+			}
+		})
+	}
+}
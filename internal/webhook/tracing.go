@@ -0,0 +1,168 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	v1 "k8s.io/api/admission/v1"
+)
+
+// tracer delegates to the global provider, spans are dropped until tracing
+// is set up and when it is disabled
+var tracer = otel.Tracer(tracerName)
+
+// startSpan starts a span of the admission, the liveness probe is never traced
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if isProbe(ctx) {
+		return ctx, noop.Span{}
+	}
+	return tracer.Start(ctx, name, opts...)
+}
+
+// propagator reads the trace context the API server sends along with the
+// admission review
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// parseSamplingRatio validates the share of the admissions traced when the
+// API server sends no trace context
+func parseSamplingRatio(ratio string) (float64, error) {
+	r, err := strconv.ParseFloat(ratio, 64)
+	if err != nil || r < 0 || r > 1 {
+		return 0, fmt.Errorf("invalid tracing sampling ratio %q, expect 0 to 1", ratio)
+	}
+	return r, nil
+}
+
+// parseTracesEndpoint validates the url of the OTLP/HTTP traces endpoint
+func parseTracesEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid traces endpoint %q, expect an http or https url", endpoint)
+	}
+	return nil
+}
+
+// setupTracing exports spans to the OTLP collector when an endpoint is set.
+// The exporter connects lazily and drops the spans it can't send, so an
+// unreachable collector never holds up an admission.
+func (w *MsmWebhook) setupTracing(ctx context.Context, c TracingConfig) error {
+	if c.Endpoint == "" {
+		return nil
+	}
+	ratio, err := parseSamplingRatio(c.SamplingRatio)
+	if err != nil {
+		return err
+	}
+
+	exporter, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpointURL(c.Endpoint),
+		otlptracehttp.WithTimeout(tracingExportTimeout),
+		// spans are best effort, retrying would only pile them up
+		otlptracehttp.WithRetry(otlptracehttp.RetryConfig{ //nolint:exhaustruct
+			Enabled: false,
+		}))
+	if err != nil {
+		return fmt.Errorf("could not create the traces exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(fieldManager),
+		semconv.ServiceVersion(Version),
+		semconv.K8SNamespaceName(w.namespace)))
+	if err != nil {
+		return err
+	}
+
+	w.tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		// follow the API server's decision when it traces the request
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))))
+	otel.SetTracerProvider(w.tracerProvider)
+	otel.SetErrorHandler(w.tracingErrorHandler())
+	w.Log.Infof("Exporting traces to %v, sampling %v of the untraced admissions", c.Endpoint, ratio)
+	return nil
+}
+
+// tracingErrorHandler logs export failures at most once per
+// tracingErrorLogInterval, a missing collector would flood the log otherwise
+func (w *MsmWebhook) tracingErrorHandler() otel.ErrorHandler {
+	var last atomic.Int64
+	return otel.ErrorHandlerFunc(func(err error) {
+		now := time.Now().UnixNano()
+		prev := last.Load()
+		if now-prev < int64(tracingErrorLogInterval) || !last.CompareAndSwap(prev, now) {
+			w.Log.Debugf("Tracing error: %v", err)
+			return
+		}
+		w.Log.Warnf("Tracing error, spans are dropped until the collector is reachable: %v", err)
+	})
+}
+
+// shutdownTracing flushes the spans left in the batch
+func (w *MsmWebhook) shutdownTracing(ctx context.Context) {
+	if w.tracerProvider == nil {
+		return
+	}
+	if err := w.tracerProvider.Shutdown(ctx); err != nil {
+		w.Log.Warnf("Could not flush the remaining spans: %v", err)
+	}
+}
+
+// failSpan marks the span as failed and answers the admission with err
+func failSpan(span trace.Span, err error) *v1.AdmissionResponse {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	return errorReviewResponse(err)
+}
+
+// requestAttributes describe the admission request on its span
+func requestAttributes(request *v1.AdmissionRequest) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("admission.uid", string(request.UID)),
+		attribute.String("admission.kind", request.Kind.Kind),
+		attribute.String("admission.namespace", request.Namespace),
+		attribute.String("admission.name", request.Name),
+		attribute.String("admission.operation", string(request.Operation)),
+		attribute.Bool("admission.dry_run", request.DryRun != nil && *request.DryRun),
+	}
+}
+
+// decisionAttributes describe the outcome of the admission on its span
+func decisionAttributes(a *admissionContext, response *v1.AdmissionResponse) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("admission.decision", a.decision),
+		attribute.String("admission.rule", a.rule),
+		attribute.Bool("admission.allowed", response.Allowed),
+		attribute.Int("admission.patch_size", len(response.Patch)),
+	}
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	v1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+//nolint:exhaustruct
+func TestHandleTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(recorder),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		_ = provider.Shutdown(context.Background())
+	})
+
+	w := newTestWebhook()
+	request := testRequest(t, map[string]string{msmLabelKey: "true"})
+	body, err := json.Marshal(v1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{Kind: admissionReviewKind, APIVersion: v1.SchemeGroupVersion.String()},
+		Request:  &request,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodPost, mutateMethod, bytes.NewReader(body))
+	req.Header.Set("Content-Type", jsonContentType)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	w.handle(httptest.NewRecorder(), req)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	for _, name := range []string{mutateMethod, "decode", "decode object", "policy", "patch", "namespace settings lookup"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Fatalf("missing span %q, got %v", name, spans)
+		}
+		if got := span.SpanContext().TraceID().String(); got != traceID {
+			t.Errorf("span %q is not part of the API server trace, got trace %v", name, got)
+		}
+	}
+	if parent := spans["patch"].Parent().SpanID(); parent != spans[mutateMethod].SpanContext().SpanID() {
+		t.Errorf("expected the patch span to be a child of the handle span, got parent %v", parent)
+	}
+
+	// the liveness probe is never traced
+	ended := len(recorder.Ended())
+	if err := w.probeHandler(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(recorder.Ended()); got != ended {
+		t.Errorf("expected the probe to leave no spans, got %v new spans", got-ended)
+	}
+}
+
+func TestParseTracingSettings(t *testing.T) {
+	for _, ratio := range []string{"0", "0.25", "1"} {
+		if _, err := parseSamplingRatio(ratio); err != nil {
+			t.Errorf("unexpected error for ratio %v: %v", ratio, err)
+		}
+	}
+	for _, ratio := range []string{"", "-0.1", "1.5", "all"} {
+		if _, err := parseSamplingRatio(ratio); err == nil {
+			t.Errorf("expected an error for ratio %q", ratio)
+		}
+	}
+	if err := parseTracesEndpoint("http://otel-collector.observability:4318/v1/traces"); err != nil {
+		t.Error(err)
+	}
+	if err := parseTracesEndpoint("otel-collector:4318"); err == nil {
+		t.Error("expected an error for an endpoint without scheme")
+	}
+}
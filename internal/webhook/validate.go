@@ -0,0 +1,223 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// validate checks that labelled workloads still satisfy the mesh invariants
+// once every mutating webhook has run
+func (w *MsmWebhook) validate(ctx context.Context, config *Config, request *v1.AdmissionRequest) *v1.AdmissionResponse {
+	w.Log.Debugf("Validation for request UID %s, Kind %s, "+
+		"Resource %s, Name %s, Namespace %s, Operation %s ",
+		request.UID, request.Kind, request.Resource, request.Name,
+		request.Namespace, request.Operation)
+
+	a := newAdmissionContext(ctx, config, request)
+	defer w.finish(a)
+
+	response := w.admit(a)
+	response.AuditAnnotations = a.auditAnnotations()
+	observeAdmission(a, validateHandler, response)
+	trace.SpanFromContext(ctx).SetAttributes(decisionAttributes(a, response)...)
+	return response
+}
+
+// admit runs the mesh invariant checks against the requested workload
+func (w *MsmWebhook) admit(a *admissionContext) *v1.AdmissionResponse {
+	request := a.request
+	if !isSupportKind(request) {
+		a.decide(decisionSkipped, ruleUnsupportedKind)
+		return okReviewResponse()
+	}
+	if request.Operation == v1.Delete {
+		a.decide(decisionSkipped, ruleDelete)
+		return okReviewResponse()
+	}
+
+	metaAndSpec, err := w.getMetaAndSpec(a)
+	if err != nil {
+		a.decide(decisionDenied, ruleInvalidObject)
+		return errorReviewResponse(err)
+	}
+
+	_, span := startSpan(a.ctx, "policy")
+	defer span.End()
+
+	if _, ok := w.msmLabelValue(a, getIgnoredNamespaces(a.config), metaAndSpec); !ok {
+		return okReviewResponse()
+	}
+
+	if w.unmeshedUpdate(a, metaAndSpec) {
+		a.decide(decisionSkipped, ruleUnmeshedWorkload)
+		w.logDecision(a, "Skipping validation for %s/%s, it had no stub before this update",
+			metaAndSpec.meta.Namespace, metaAndSpec.meta.Name)
+		return okReviewResponse()
+	}
+
+	var reasons []string
+	for _, v := range []struct {
+		rule  string
+		check func() []string
+	}{
+		{rule: ruleStubConfig, check: func() []string { return validateStub(a.config, metaAndSpec) }},
+		{rule: ruleHostNetwork, check: func() []string { return validateHostNetwork(a.config, metaAndSpec) }},
+		{rule: ruleStubUID, check: func() []string { return validateStubUID(a.config, metaAndSpec.spec) }},
+	} {
+		if failed := v.check(); len(failed) > 0 {
+			a.decide(decisionDenied, v.rule)
+			reasons = append(reasons, failed...)
+		}
+	}
+	if len(reasons) > 0 {
+		w.logDecision(a, "Denying %s %s/%s: %v", request.Kind.Kind, metaAndSpec.meta.Namespace,
+			metaAndSpec.meta.Name, strings.Join(reasons, "; "))
+		return deniedReviewResponse(reasons)
+	}
+
+	a.decide(decisionAllowed, ruleMeshInvariants)
+	return okReviewResponse()
+}
+
+// unmeshedUpdate reports an update of a workload that had no stub before and
+// still has none, e.g. one created before the webhook was installed. Denying
+// it would block routine edits, the stub is injected when it is recreated.
+func (w *MsmWebhook) unmeshedUpdate(a *admissionContext, tuple *podSpecAndMeta) bool {
+	if a.request.Operation != v1.Update || len(a.request.OldObject.Raw) == 0 || stubContainer(a.config, tuple.spec) != nil {
+		return false
+	}
+	old, err := w.decodeMetaAndSpec(a.request.Kind.Kind, a.request.OldObject.Raw)
+	return err == nil && stubContainer(a.config, old.spec) == nil
+}
+
+// validateStub checks that the stub is present exactly once and configured
+// the way the mutating webhook injects it
+func validateStub(config *Config, tuple *podSpecAndMeta) []string {
+	count := 0
+	for _, c := range tuple.spec.Containers {
+		if c.Name == getSidecar(config) {
+			count++
+		}
+	}
+	switch {
+	case count == 0:
+		return []string{fmt.Sprintf("labelled workload is missing the %v container", getSidecar(config))}
+	case count > 1:
+		return []string{fmt.Sprintf("labelled workload contains %v %v containers", count, getSidecar(config))}
+	}
+
+	var reasons []string
+	stub := stubContainer(config, tuple.spec)
+	image := fmt.Sprintf("%s/%s", getRepo(config), getSidecar(config))
+	if !strings.HasPrefix(stub.Image, image+":") && !strings.HasPrefix(stub.Image, image+"@") {
+		reasons = append(reasons, fmt.Sprintf("%v container image %v is not a %v image", stub.Name, stub.Image, image))
+	}
+
+	sc := stub.SecurityContext
+	if sc == nil || sc.RunAsUser == nil || *sc.RunAsUser != stubUID {
+		reasons = append(reasons, fmt.Sprintf("%v container must run as user %v", stub.Name, stubUID))
+	}
+	if sc == nil || sc.AllowPrivilegeEscalation == nil || *sc.AllowPrivilegeEscalation {
+		reasons = append(reasons, fmt.Sprintf("%v container must not allow privilege escalation", stub.Name))
+	}
+
+	ports, err := portPlan(tuple)
+	if err != nil {
+		return append(reasons, err.Error())
+	}
+	for _, name := range stubPortNames {
+		if !hasContainerPort(stub, name, ports[name]) {
+			reasons = append(reasons, fmt.Sprintf("%v container is missing %v port %v", stub.Name, name, ports[name]))
+		}
+	}
+
+	return reasons
+}
+
+// validateHostNetwork checks that media pods on the host network declare a
+// port plan that does not collide with the application ports
+func validateHostNetwork(config *Config, tuple *podSpecAndMeta) []string {
+	if !tuple.spec.HostNetwork {
+		return nil
+	}
+
+	if _, ok := tuple.meta.GetAnnotations()[msmPortPlanKey]; !ok {
+		return []string{fmt.Sprintf("hostNetwork media workloads require the %v annotation", msmPortPlanKey)}
+	}
+	ports, err := portPlan(tuple)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var reasons []string
+	for _, c := range tuple.spec.Containers {
+		if c.Name == getSidecar(config) {
+			continue
+		}
+		for _, p := range c.Ports {
+			for _, name := range stubPortNames {
+				if p.ContainerPort == ports[name] {
+					reasons = append(reasons, fmt.Sprintf("container %v port %v collides with the %v %v port",
+						c.Name, p.ContainerPort, msmPortPlanKey, name))
+				}
+			}
+		}
+	}
+	return reasons
+}
+
+// validateStubUID checks that no application container runs as the stub user
+func validateStubUID(config *Config, spec *corev1.PodSpec) []string {
+	var reasons []string
+	containers := append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, c := range containers {
+		if c.Name == getSidecar(config) {
+			continue
+		}
+		uid := podRunAsUser(spec)
+		if c.SecurityContext != nil && c.SecurityContext.RunAsUser != nil {
+			uid = c.SecurityContext.RunAsUser
+		}
+		if uid != nil && *uid == stubUID {
+			reasons = append(reasons, fmt.Sprintf("container %v must not run as the stub user %v", c.Name, stubUID))
+		}
+	}
+	return reasons
+}
+
+func podRunAsUser(spec *corev1.PodSpec) *int64 {
+	if spec.SecurityContext == nil {
+		return nil
+	}
+	return spec.SecurityContext.RunAsUser
+}
+
+func hasContainerPort(c *corev1.Container, name string, port int32) bool {
+	for _, p := range c.Ports {
+		if p.Name == name && p.ContainerPort == port {
+			return true
+		}
+	}
+	return false
+}
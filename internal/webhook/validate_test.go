@@ -0,0 +1,190 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func testStub() corev1.Container {
+	return renderMsmContainer(currentConfig(), nil, map[string]int32{
+		rtspPortName: defaultRTSPPort,
+		rtpPortName:  defaultRTPPort,
+		rtcpPortName: defaultRTCPPort,
+	}, nil)
+}
+
+//nolint:exhaustruct
+func rawPod(t *testing.T, containers ...corev1.Container) runtime.RawExtension {
+	t.Helper()
+	return rawPodSpec(t, nil, corev1.PodSpec{Containers: containers})
+}
+
+//nolint:exhaustruct
+func rawPodSpec(t *testing.T, annotations map[string]string, spec corev1.PodSpec) runtime.RawExtension {
+	t.Helper()
+	raw, err := json.Marshal(corev1.Pod{
+		TypeMeta: metav1.TypeMeta{Kind: pod, APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "camera",
+			Namespace:   "media",
+			Labels:      map[string]string{msmLabelKey: "true"},
+			Annotations: annotations,
+		},
+		Spec: spec,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runtime.RawExtension{Raw: raw}
+}
+
+//nolint:exhaustruct
+func TestValidate(t *testing.T) {
+	app := corev1.Container{Name: "app", Image: "app:1.0"}
+	rootStub := testStub()
+	rootStub.SecurityContext = nil
+	empty := runtime.RawExtension{}
+	rtspApp := corev1.Container{Name: "app", Image: "app:1.0",
+		Ports: []corev1.ContainerPort{{ContainerPort: defaultRTSPPort}}}
+	stubUser := int64(stubUID)
+	appUser := int64(1000)
+	stubUserApp := corev1.Container{Name: "app", Image: "app:1.0",
+		SecurityContext: &corev1.SecurityContext{RunAsUser: &stubUser}}
+	hostNetwork := func(containers ...corev1.Container) corev1.PodSpec {
+		return corev1.PodSpec{HostNetwork: true, Containers: containers}
+	}
+	defaultPlan := map[string]string{msmPortPlanKey: "rtsp=8554,rtp=8050,rtcp=8051"}
+
+	for _, tc := range []struct {
+		name      string
+		operation v1.Operation
+		object    runtime.RawExtension
+		oldObject runtime.RawExtension
+		allowed   bool
+		decision  string
+		rule      string
+	}{
+		{name: "unlabelled", operation: v1.Create, object: testPod(t, nil),
+			allowed: true, decision: decisionSkipped, rule: ruleNoLabel},
+		{name: "meshed", operation: v1.Create, object: rawPod(t, app, testStub()),
+			allowed: true, decision: decisionAllowed, rule: ruleMeshInvariants},
+		{name: "missing stub", operation: v1.Create, object: rawPod(t, app),
+			allowed: false, decision: decisionDenied, rule: ruleStubConfig},
+		{name: "stub without security context", operation: v1.Create, object: rawPod(t, app, rootStub),
+			allowed: false, decision: decisionDenied, rule: ruleStubConfig},
+		{name: "host network without port plan", operation: v1.Create,
+			object:  rawPodSpec(t, nil, hostNetwork(app, testStub())),
+			allowed: false, decision: decisionDenied, rule: ruleHostNetwork},
+		{name: "host network with port plan", operation: v1.Create,
+			object:  rawPodSpec(t, defaultPlan, hostNetwork(app, testStub())),
+			allowed: true, decision: decisionAllowed, rule: ruleMeshInvariants},
+		{name: "host network port collision", operation: v1.Create,
+			object:  rawPodSpec(t, defaultPlan, hostNetwork(rtspApp, testStub())),
+			allowed: false, decision: decisionDenied, rule: ruleHostNetwork},
+		{name: "invalid port plan", operation: v1.Create,
+			object: rawPodSpec(t, map[string]string{msmPortPlanKey: "rtsp=0"},
+				corev1.PodSpec{Containers: []corev1.Container{app, testStub()}}),
+			allowed: false, decision: decisionDenied, rule: ruleStubConfig},
+		{name: "app container as stub user", operation: v1.Create, object: rawPod(t, stubUserApp, testStub()),
+			allowed: false, decision: decisionDenied, rule: ruleStubUID},
+		{name: "pod security context as stub user", operation: v1.Create,
+			object: rawPodSpec(t, nil, corev1.PodSpec{
+				SecurityContext: &corev1.PodSecurityContext{RunAsUser: &stubUser},
+				Containers:      []corev1.Container{app, testStub()},
+			}),
+			allowed: false, decision: decisionDenied, rule: ruleStubUID},
+		{name: "app container overriding the pod user", operation: v1.Create,
+			object: rawPodSpec(t, nil, corev1.PodSpec{
+				SecurityContext: &corev1.PodSecurityContext{RunAsUser: &stubUser},
+				Containers: []corev1.Container{
+					{Name: "app", Image: "app:1.0", SecurityContext: &corev1.SecurityContext{RunAsUser: &appUser}},
+					testStub(),
+				},
+			}),
+			allowed: true, decision: decisionAllowed, rule: ruleMeshInvariants},
+		{name: "update of a workload created before the stub", operation: v1.Update,
+			object: rawPod(t, app), oldObject: rawPod(t, app),
+			allowed: true, decision: decisionSkipped, rule: ruleUnmeshedWorkload},
+		{name: "update removing the stub", operation: v1.Update,
+			object: rawPod(t, app), oldObject: rawPod(t, app, testStub()),
+			allowed: false, decision: decisionDenied, rule: ruleStubConfig},
+		{name: "update without old object", operation: v1.Update, object: rawPod(t, app), oldObject: empty,
+			allowed: false, decision: decisionDenied, rule: ruleStubConfig},
+		{name: "delete", operation: v1.Delete, object: empty, oldObject: rawPod(t, app),
+			allowed: true, decision: decisionSkipped, rule: ruleDelete},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			request := testRequest(t, nil)
+			request.Operation = tc.operation
+			request.Object = tc.object
+			request.OldObject = tc.oldObject
+
+			response := newTestWebhook().validate(context.Background(), currentConfig(), &request)
+			if response.Allowed != tc.allowed {
+				t.Fatalf("expected allowed=%v, got %v: %v", tc.allowed, response.Allowed, response.Result)
+			}
+			if got := response.AuditAnnotations[auditDecisionKey]; got != tc.decision {
+				t.Errorf("expected decision %v, got %v", tc.decision, got)
+			}
+			if got := response.AuditAnnotations[auditRuleKey]; got != tc.rule {
+				t.Errorf("expected rule %v, got %v", tc.rule, got)
+			}
+		})
+	}
+}
+
+func TestParsePortPlan(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		value   string
+		wantErr string
+	}{
+		{name: "valid", value: "rtsp=9554, rtp=9050, rtcp=9051"},
+		{name: "missing separator", value: "rtsp", wantErr: "expect name=port"},
+		{name: "unknown name", value: "http=80,rtsp=9554,rtp=9050,rtcp=9051", wantErr: "name must be one of"},
+		{name: "duplicate name", value: "rtsp=9554,rtsp=9555", wantErr: "duplicate"},
+		{name: "not a number", value: "rtsp=abc", wantErr: "invalid port"},
+		{name: "out of range", value: "rtsp=65536", wantErr: "invalid port"},
+		{name: "shared port", value: "rtsp=9554,rtp=9554", wantErr: "to both rtsp and rtp"},
+		{name: "incomplete", value: "rtsp=9554,rtp=9050", wantErr: "missing a port for rtcp"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ports, err := parsePortPlan(tc.value)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ports[rtspPortName] != 9554 || ports[rtpPortName] != 9050 || ports[rtcpPortName] != 9051 {
+				t.Errorf("unexpected ports %v", ports)
+			}
+		})
+	}
+}
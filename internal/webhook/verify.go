@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// verifyPatch applies the generated patch to the original object, the same
+// way the API server will, and checks that the result is still a valid
+// workload of the requested kind
+func (w *MsmWebhook) verifyPatch(kind string, original, patchBytes []byte) error {
+	patch, err := jsonpatch.DecodePatch(patchBytes)
+	if err != nil {
+		return fmt.Errorf("invalid patch: %w", err)
+	}
+
+	patched, err := patch.Apply(original)
+	if err != nil {
+		return fmt.Errorf("patch does not apply to the %v: %w", kind, err)
+	}
+
+	tuple, err := w.decodeMetaAndSpec(kind, patched)
+	if err != nil {
+		return fmt.Errorf("patched object is not a valid %v: %w", kind, err)
+	}
+
+	// the patch is only blamed for what it broke, the API server reports
+	// the errors already in the user's spec on its own
+	existing := make(map[string]bool)
+	if before, err := w.decodeMetaAndSpec(kind, original); err == nil {
+		for _, e := range validatePodSpec(before.spec) {
+			existing[e.Error()] = true
+		}
+	}
+	var introduced []error
+	for _, e := range validatePodSpec(tuple.spec) {
+		if !existing[e.Error()] {
+			introduced = append(introduced, e)
+		}
+	}
+	if len(introduced) > 0 {
+		return fmt.Errorf("patched %v has an invalid pod spec: %w", kind, errors.Join(introduced...))
+	}
+	return nil
+}
+
+// validatePodSpec runs a subset of the API server pod spec validation, enough
+// to catch patches that broke the spec. Errors name the containers by index,
+// which the appended stub leaves unchanged.
+func validatePodSpec(spec *corev1.PodSpec) []error {
+	var errs []error
+	if len(spec.Containers) == 0 {
+		errs = append(errs, errors.New("spec.containers must not be empty"))
+	}
+
+	volumes := make(map[string]bool)
+	for _, v := range spec.Volumes {
+		volumes[v.Name] = true
+	}
+
+	names := make(map[string]bool)
+	check := func(path string, c *corev1.Container) {
+		if msgs := validation.IsDNS1123Label(c.Name); len(msgs) > 0 {
+			errs = append(errs, fmt.Errorf("%v.name %q: %v", path, c.Name, strings.Join(msgs, ", ")))
+		}
+		if names[c.Name] {
+			errs = append(errs, fmt.Errorf("%v.name %q is duplicated", path, c.Name))
+		}
+		names[c.Name] = true
+
+		if c.Image == "" {
+			errs = append(errs, fmt.Errorf("%v.image must not be empty", path))
+		}
+
+		ports := make(map[string]bool)
+		for j, p := range c.Ports {
+			if p.ContainerPort < 1 || p.ContainerPort > 65535 {
+				errs = append(errs, fmt.Errorf("%v.ports[%d].containerPort %v is out of range", path, j, p.ContainerPort))
+			}
+			if p.Name == "" {
+				continue
+			}
+			if ports[p.Name] {
+				errs = append(errs, fmt.Errorf("%v.ports[%d].name %q is duplicated", path, j, p.Name))
+			}
+			ports[p.Name] = true
+		}
+
+		for j, e := range c.Env {
+			if e.Name == "" {
+				errs = append(errs, fmt.Errorf("%v.env[%d].name must not be empty", path, j))
+			}
+			if e.Value != "" && e.ValueFrom != nil {
+				errs = append(errs, fmt.Errorf("%v.env[%d] sets both value and valueFrom", path, j))
+			}
+		}
+
+		for j, m := range c.VolumeMounts {
+			if !volumes[m.Name] {
+				errs = append(errs, fmt.Errorf("%v.volumeMounts[%d] references unknown volume %q", path, j, m.Name))
+			}
+		}
+	}
+
+	for i := range spec.InitContainers {
+		check(fmt.Sprintf("spec.initContainers[%d]", i), &spec.InitContainers[i])
+	}
+	for i := range spec.Containers {
+		check(fmt.Sprintf("spec.containers[%d]", i), &spec.Containers[i])
+	}
+	return errs
+}
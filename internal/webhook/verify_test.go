@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+//nolint:exhaustruct
+func TestVerifyPatch(t *testing.T) {
+	podWith := func(containers ...corev1.Container) []byte {
+		raw, err := json.Marshal(corev1.Pod{
+			TypeMeta:   metav1.TypeMeta{Kind: pod, APIVersion: "v1"},
+			ObjectMeta: metav1.ObjectMeta{Name: "camera", Namespace: "media"},
+			Spec:       corev1.PodSpec{Containers: containers},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	app := corev1.Container{Name: "app", Image: "app:1.0"}
+	noImage := corev1.Container{Name: "app"}
+	appendStub := `[{"op":"add","path":"/spec/containers/-","value":{"name":"msm-rtsp-stub","image":"stub:1.0"}}]`
+
+	for _, tc := range []struct {
+		name     string
+		original []byte
+		patch    string
+		err      string
+	}{
+		{name: "valid", original: podWith(app), patch: appendStub},
+		{name: "error already in the spec", original: podWith(noImage), patch: appendStub},
+		{name: "duplicated container", original: podWith(app),
+			patch: `[{"op":"add","path":"/spec/containers/-","value":{"name":"app","image":"stub:1.0"}}]`,
+			err:   `spec.containers[1].name "app" is duplicated`},
+		{name: "new error next to an existing one", original: podWith(noImage),
+			patch: `[{"op":"add","path":"/spec/containers/-","value":{"name":"msm-rtsp-stub"}}]`,
+			err:   "spec.containers[1].image must not be empty"},
+		{name: "does not apply", original: podWith(app),
+			patch: `[{"op":"replace","path":"/spec/missing","value":1}]`, err: "does not apply"},
+		{name: "invalid patch", original: podWith(app), patch: `{}`, err: "invalid patch"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := newTestWebhook().verifyPatch(pod, tc.original, []byte(tc.patch))
+			switch {
+			case tc.err == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Fatalf("expected error %q, got %v", tc.err, err)
+			case err != nil && strings.Contains(err.Error(), "spec.containers[0]"):
+				t.Fatalf("blamed the patch for an error of the original spec: %v", err)
+			}
+		})
+	}
+}
+
+//nolint:exhaustruct
+func TestMutateDeniesInvalidPatch(t *testing.T) {
+	// an init container named like the stub collides with the injected one
+	var p corev1.Pod
+	request := testRequest(t, map[string]string{msmLabelKey: "true"})
+	if err := json.Unmarshal(request.Object.Raw, &p); err != nil {
+		t.Fatal(err)
+	}
+	p.Spec.InitContainers = []corev1.Container{{Name: getSidecar(currentConfig()), Image: "init:1.0"}}
+	raw, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Object.Raw = raw
+
+	failures := testutil.ToFloat64(patchVerificationFailuresTotal.WithLabelValues(pod))
+	response := newTestWebhook().mutate(context.Background(), currentConfig(), &request)
+	if response.Allowed || response.AuditAnnotations[auditRuleKey] != rulePatchVerification {
+		t.Fatalf("expected a patch verification denial, got %+v", response)
+	}
+	if got := testutil.ToFloat64(patchVerificationFailuresTotal.WithLabelValues(pod)); got != failures+1 {
+		t.Errorf("expected the failure to be counted, got %v after %v", got, failures)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// warningCheck reports non-fatal problems of a labelled workload, they are
+// returned to the client as AdmissionResponse warnings
+type warningCheck struct {
+	name  string
+	check func(a *admissionContext, tuple *podSpecAndMeta) []string
+}
+
+var warningChecks = []warningCheck{
+	{name: latestImageWarning, check: warnLatestImage},
+	{name: missingLimitsWarning, check: warnMissingLimits},
+	{name: hostNetworkWarning, check: warnHostNetwork},
+	{name: deprecatedAnnotationWarning, check: warnDeprecatedAnnotation},
+	{name: autoInjectionWarning, check: warnAutoInjection},
+}
+
+// deprecatedAnnotations lists deprecated annotations with their replacement
+var deprecatedAnnotations = []struct{ key, replacement string }{
+	{key: msmLabelKey, replacement: "the " + msmLabelKey + " label"},
+}
+
+// warnings runs the enabled warning checks against the workload
+func (w *MsmWebhook) warnings(a *admissionContext, tuple *podSpecAndMeta) []string {
+	enabled := getEnabledWarnings(a.config)
+
+	var result []string
+	for _, c := range warningChecks {
+		if !enabled[c.name] {
+			continue
+		}
+		found := c.check(a, tuple)
+		if len(found) == 0 {
+			continue
+		}
+		name := c.name
+		a.sideEffect(func() {
+			warningsTotal.WithLabelValues(name).Add(float64(len(found)))
+		})
+		result = append(result, found...)
+	}
+	return result
+}
+
+func warnLatestImage(a *admissionContext, tuple *podSpecAndMeta) []string {
+	image := getStubImage(a.config)
+	if stub := stubContainer(a.config, tuple.spec); stub != nil {
+		image = stub.Image
+	}
+	if usesLatestTag(image) {
+		return []string{fmt.Sprintf("stub image %v uses the latest tag, pin a version instead", image)}
+	}
+	return nil
+}
+
+func warnMissingLimits(a *admissionContext, tuple *podSpecAndMeta) []string {
+	var result []string
+	for _, c := range tuple.spec.Containers {
+		if c.Name == getSidecar(a.config) {
+			continue
+		}
+		_, cpu := c.Resources.Limits[corev1.ResourceCPU]
+		_, memory := c.Resources.Limits[corev1.ResourceMemory]
+		if !cpu || !memory {
+			result = append(result, fmt.Sprintf("container %v has no cpu or memory limits", c.Name))
+		}
+	}
+	return result
+}
+
+func warnHostNetwork(_ *admissionContext, tuple *podSpecAndMeta) []string {
+	if tuple.spec.HostNetwork {
+		return []string{"media workload uses hostNetwork, the stub ports are bound on the node"}
+	}
+	return nil
+}
+
+func warnDeprecatedAnnotation(_ *admissionContext, tuple *podSpecAndMeta) []string {
+	var result []string
+	for _, d := range deprecatedAnnotations {
+		if _, ok := tuple.meta.GetAnnotations()[d.key]; ok {
+			result = append(result, fmt.Sprintf("annotation %v is deprecated, use %v", d.key, d.replacement))
+		}
+	}
+	return result
+}
+
+func warnAutoInjection(a *admissionContext, _ *podSpecAndMeta) []string {
+	if a.injected {
+		return []string{fmt.Sprintf("%v container was injected by the msm admission webhook", getSidecar(a.config))}
+	}
+	return nil
+}
+
+// usesLatestTag reports whether the image resolves to the latest tag
+func usesLatestTag(image string) bool {
+	if strings.Contains(image, "@") {
+		return false
+	}
+	name := image[strings.LastIndex(image, "/")+1:]
+	tag := ""
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		tag = name[i+1:]
+	}
+	return tag == "" || tag == latestTag
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestUsesLatestTag(t *testing.T) {
+	for image, want := range map[string]bool{
+		"ciscolabs/msm-rtsp-stub":                         true,
+		"ciscolabs/msm-rtsp-stub:latest":                  true,
+		"registry.example.com:5000/msm-rtsp-stub":         true,
+		"registry.example.com:5000/msm-rtsp-stub:1.0":     false,
+		"ciscolabs/msm-rtsp-stub:1.0":                     false,
+		"ciscolabs/msm-rtsp-stub@sha256:0123456789abcdef": false,
+		"ciscolabs/msm-rtsp-stub:latest-rc":               false,
+	} {
+		if got := usesLatestTag(image); got != want {
+			t.Errorf("usesLatestTag(%v) = %v, expect %v", image, got, want)
+		}
+	}
+}
+
+// withInjectionConfig makes the given injection settings active for the test
+func withInjectionConfig(t *testing.T, fn func(*InjectionConfig)) {
+	t.Helper()
+	previous := currentConfig()
+	config := DefaultConfig()
+	fn(&config.Injection)
+	activeConfig.Store(config)
+	t.Cleanup(func() { activeConfig.Store(previous) })
+}
+
+func TestWarnings(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		tag      string
+		warnings string
+		want     []string
+	}{
+		{name: "all enabled", tag: "latest", warnings: "",
+			want: []string{"latest tag", "no cpu or memory limits", "was injected"}},
+		{name: "pinned tag", tag: "1.0", warnings: "",
+			want: []string{"no cpu or memory limits", "was injected"}},
+		{name: "selected", tag: "latest", warnings: "latest-image, host-network",
+			want: []string{"latest tag"}},
+		{name: "disabled", tag: "latest", warnings: "none", want: nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withInjectionConfig(t, func(in *InjectionConfig) {
+				in.Tag = tc.tag
+				in.Warnings = tc.warnings
+			})
+			request := testRequest(t, map[string]string{msmLabelKey: "true"})
+			response := newTestWebhook().mutate(context.Background(), currentConfig(), &request)
+			if len(response.Warnings) != len(tc.want) {
+				t.Fatalf("expected %v warnings, got %q", len(tc.want), response.Warnings)
+			}
+			for i, want := range tc.want {
+				if !strings.Contains(response.Warnings[i], want) {
+					t.Errorf("expected warning %q, got %q", want, response.Warnings[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMutateUsesConfigSnapshot(t *testing.T) {
+	snapshot := DefaultConfig()
+	snapshot.Injection.Sidecar = "msm-snapshot-stub"
+	snapshot.Injection.Tag = "1.0"
+	// a reload during the admission must not change the rendered stub
+	withInjectionConfig(t, func(c *InjectionConfig) { c.Tag = "2.0" })
+
+	request := testRequest(t, map[string]string{msmLabelKey: "true"})
+	response := newTestWebhook().mutate(context.Background(), snapshot, &request)
+	var patch []struct {
+		Value corev1.Container `json:"value"`
+	}
+	if err := json.Unmarshal(response.Patch, &patch); err != nil || len(patch) != 1 {
+		t.Fatalf("expected a single patch operation, got %s: %v", response.Patch, err)
+	}
+	if stub := patch[0].Value; stub.Name != "msm-snapshot-stub" || stub.Image != getStubImage(snapshot) {
+		t.Errorf("expected the stub of the snapshot, got %v %v", stub.Name, stub.Image)
+	}
+	for _, warning := range response.Warnings {
+		if strings.Contains(warning, getSidecar(currentConfig())) {
+			t.Errorf("expected the warnings to name the stub of the snapshot, got %q", warning)
+		}
+	}
+}
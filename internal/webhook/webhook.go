@@ -18,19 +18,29 @@ package webhook
 
 import (
 	"context"
+	"crypto"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"sync"
 
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 
 	admissionregistrationclientv1 "k8s.io/client-go/kubernetes/typed/admissionregistration/v1"
 )
@@ -60,11 +70,27 @@ func UseDeps(cb func(*Deps)) Option {
 type MsmWebhook struct {
 	Deps
 
-	server       *http.Server
-	deserializer runtime.Decoder
-	caBundle     []byte
-	client       admissionregistrationclientv1.AdmissionregistrationV1Interface
-	namespace    string
+	server              *http.Server
+	deserializer        runtime.Decoder
+	kube                kubernetes.Interface
+	client              admissionregistrationclientv1.AdmissionregistrationV1Interface
+	namespace           string
+	certMode            string
+	certOpts            *certOptions
+	managed             *managedConfigs
+	register            *registrationOptions
+	shutdownPolicy      string
+	registrationBackoff *backoffOptions
+	recorder            record.EventRecorder
+	health              health
+	overrides           namespaceOverrides
+	tracerProvider      *sdktrace.TracerProvider
+
+	certMu     sync.RWMutex
+	cert       *tls.Certificate
+	caBundle   []byte
+	signingCA  *x509.Certificate
+	signingKey crypto.Signer
 }
 
 // Deps list dependencies for the Server
@@ -87,13 +113,40 @@ func (w *MsmWebhook) Init(ctx context.Context) error {
 	w.Log.Infof("current namespace is %v", string(currentNamespace))
 	w.namespace = string(currentNamespace)
 
-	runtimeScheme := runtime.NewScheme()
-	w.deserializer = serializer.NewCodecFactory(runtimeScheme).UniversalDeserializer()
+	w.deserializer = newDeserializer()
 
-	// create certificates
-	cert := w.selfSignedCert()
+	w.certMode, err = certMode()
+	if err != nil {
+		return err
+	}
+	w.certOpts, err = parseCertOptions(w.certMode)
+	if err != nil {
+		return err
+	}
+	w.managed, err = parseManagedConfigs()
+	if err != nil {
+		return err
+	}
+	w.register, err = parseRegistrationOptions(w.namespace)
+	if err != nil {
+		return err
+	}
+	w.shutdownPolicy, err = parseShutdownPolicy(w.register)
+	if err != nil {
+		return err
+	}
+	w.registrationBackoff, err = parseBackoffOptions()
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := w.tlsConfig()
+	if err != nil {
+		return err
+	}
+	if err = w.setupTracing(ctx, currentConfig().Tracing); err != nil {
+		return err
+	}
 
-	// admission webhook registration
 	c, err := rest.InClusterConfig()
 	if err != nil {
 		return err
@@ -103,40 +156,117 @@ func (w *MsmWebhook) Init(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	w.kube = clientset
 	w.client = clientset.AdmissionregistrationV1()
+	w.bindConfigKinds()
 
-	err = w.patchMutatingWebhookConfig(ctx, MsmWHConfigName)
-	if err != nil {
+	w.recorder = w.newEventRecorder(ctx)
+
+	if w.register != nil {
+		if err = w.checkFailurePolicy(ctx); err != nil {
+			return err
+		}
+	}
+
+	if err = prometheus.Register(certExpiryCollector{w: w}); err != nil {
 		return err
 	}
 
+	// create or load certificates, and register the admission webhook
+	switch w.certMode {
+	case certModeSelfSigned:
+		// every replica serves the certificate shared through the CA
+		// secret, only the leader creates it and patches the caBundle
+		if err = w.runLeaderElection(ctx); err != nil {
+			return err
+		}
+		if err = w.waitForCASecret(ctx); err != nil {
+			return err
+		}
+		w.watchCASecret(ctx)
+		go w.rotateServingCert(ctx)
+	case certModeFile, certModeCertManager:
+		files := &certFiles{dir: CertDir, last: certFilesChecksum(CertDir), caBundle: nil}
+		cert, caBundle, err := loadCertFiles(CertDir)
+		if err != nil {
+			return err
+		}
+		files.caBundle = caBundle
+		w.setCertificate(cert, caBundle)
+		w.Log.Infof("Loaded certificate from %v, valid until %v", CertDir, cert.Leaf.NotAfter)
+
+		if w.certMode == certModeCertManager {
+			// cert-manager's CA injector owns the caBundle, patching it
+			// here would fight the injector
+			if w.register != nil {
+				if err = w.applyMutatingWebhookConfig(ctx, MsmWHConfigName); err != nil {
+					return err
+				}
+			}
+			w.checkCABundles(ctx)
+		} else if err = w.patchWebhookConfigs(ctx); err != nil {
+			return err
+		}
+		if w.certMode != certModeCertManager || w.register != nil {
+			w.reconcileWebhookConfigs(ctx)
+		}
+		go w.watchCertFiles(ctx, files)
+	}
+
 	// http server and server handler initialization
 	w.server = &http.Server{
 		Addr:                         fmt.Sprintf(":%v", defaultPort),
 		Handler:                      nil,
 		DisableGeneralOptionsHandler: false,
-		TLSConfig: &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			MinVersion:   tls.VersionTLS12,
-		},
-		ReadHeaderTimeout: readerTimeout,
+		TLSConfig:                    tlsConfig,
+		ReadHeaderTimeout:            readHeaderTimeout,
+		ReadTimeout:                  readTimeout,
+		WriteTimeout:                 writeTimeout,
+		IdleTimeout:                  idleTimeout,
 	}
+	if name := currentConfig().Injection.NamespaceConfigMap; name != "" {
+		w.watchNamespaceSettings(ctx, name)
+	}
+	go w.watchRegistration(ctx)
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/mutate", w.handle)
+	mux.HandleFunc(mutateMethod, w.handle)
+	mux.HandleFunc(validateMethod, w.handle)
 	w.server.Handler = mux
 
 	return nil
 }
 
+// newDeserializer returns a decoder for the supported AdmissionReview versions
+func newDeserializer() runtime.Decoder {
+	runtimeScheme := runtime.NewScheme()
+	utilruntime.Must(admissionv1.AddToScheme(runtimeScheme))
+	utilruntime.Must(admissionv1beta1.AddToScheme(runtimeScheme))
+	return serializer.NewCodecFactory(runtimeScheme).UniversalDeserializer()
+}
+
 // Start starts the webhook server
 func (w *MsmWebhook) Start() error {
+	ln, err := net.Listen("tcp", w.server.Addr)
+	if err != nil {
+		return err
+	}
+	w.health.serving.Store(true)
+	defer w.health.serving.Store(false)
 	w.Log.Infof("Server successfully started: listening on port %d", defaultPort)
 
-	return w.server.ListenAndServeTLS("", "")
+	return w.server.ServeTLS(ln, "", "")
 }
 
-// Close safely closes the server
+// Close safely closes the server, after applying the shutdown policy while
+// admission requests are still served
 func (w *MsmWebhook) Close() {
 	defer w.Log.Infof("Server successfully closed")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	w.deregister(ctx)
+
 	_ = w.server.Close()
+	w.shutdownTracing(ctx)
 }
@@ -0,0 +1,259 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	admitv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	mutatingKind   = "MutatingWebhookConfiguration"
+	validatingKind = "ValidatingWebhookConfiguration"
+)
+
+// webhookConfig is a mutating or validating webhook configuration, seen
+// through the client configs of its webhooks
+type webhookConfig struct {
+	meta     metav1.Object
+	object   runtime.Object
+	webhooks []webhookClientConfig
+	update   func(ctx context.Context) error
+}
+
+type webhookClientConfig struct {
+	name          string
+	config        *admitv1.WebhookClientConfig
+	failurePolicy **admitv1.FailurePolicyType
+}
+
+// webhookConfigKind reads and lists the configurations of one kind, and
+// knows which of them the webhook manages
+type webhookConfigKind struct {
+	kind     string
+	names    []string
+	selector labels.Selector
+	get      func(ctx context.Context, name string) (*webhookConfig, error)
+	list     func(ctx context.Context, selector string) ([]*webhookConfig, error)
+	wrap     func(obj interface{}) (*webhookConfig, bool)
+	informer func(factory informers.SharedInformerFactory) cache.SharedIndexInformer
+}
+
+// managedConfigs are the webhook configurations whose caBundle the webhook
+// manages, by name or label selector
+type managedConfigs struct {
+	mutating   *webhookConfigKind
+	validating *webhookConfigKind
+}
+
+// parseManagedConfigs validates the names and selectors of the managed
+// webhook configurations
+func parseManagedConfigs() (*managedConfigs, error) {
+	m := &managedConfigs{
+		mutating:   &webhookConfigKind{kind: mutatingKind},   //nolint:exhaustruct
+		validating: &webhookConfigKind{kind: validatingKind}, //nolint:exhaustruct
+	}
+	for _, c := range []struct {
+		kind     *webhookConfigKind
+		name     string
+		names    string
+		selector string
+	}{
+		{kind: m.mutating, name: MsmWHConfigName, names: MutatingWebhookConfigs, selector: MutatingWebhookSelector},
+		{kind: m.validating, name: MsmValidatingWHConfigName, names: ValidatingWebhookConfigs, selector: ValidatingWebhookSelector},
+	} {
+		for _, name := range append([]string{c.name}, strings.Split(c.names, ",")...) {
+			name = strings.TrimSpace(name)
+			if name != "" && !slices.Contains(c.kind.names, name) {
+				c.kind.names = append(c.kind.names, name)
+			}
+		}
+		if c.selector != "" {
+			selector, err := labels.Parse(c.selector)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %v selector %q: %w", c.kind.kind, c.selector, err)
+			}
+			c.kind.selector = selector
+		}
+	}
+
+	if len(m.mutating.names) == 0 && m.mutating.selector == nil &&
+		len(m.validating.names) == 0 && m.validating.selector == nil {
+		return nil, fmt.Errorf("no webhook configuration to manage, set a name or a selector")
+	}
+	return m, nil
+}
+
+func (m *managedConfigs) kinds() []*webhookConfigKind {
+	return []*webhookConfigKind{m.mutating, m.validating}
+}
+
+// bindConfigKinds binds the managed configurations to the API clients
+func (w *MsmWebhook) bindConfigKinds() {
+	mutating := w.managed.mutating
+	mutating.get = func(ctx context.Context, name string) (*webhookConfig, error) {
+		config, err := w.client.MutatingWebhookConfigurations().Get(ctx, name, metav1.GetOptions{}) //nolint:exhaustruct
+		if err != nil {
+			return nil, err
+		}
+		return w.mutatingConfig(config), nil
+	}
+	mutating.list = func(ctx context.Context, selector string) ([]*webhookConfig, error) {
+		list, err := w.client.MutatingWebhookConfigurations().List(ctx, metav1.ListOptions{ //nolint:exhaustruct
+			LabelSelector: selector,
+		})
+		if err != nil {
+			return nil, err
+		}
+		configs := make([]*webhookConfig, 0, len(list.Items))
+		for i := range list.Items {
+			configs = append(configs, w.mutatingConfig(&list.Items[i]))
+		}
+		return configs, nil
+	}
+	mutating.wrap = func(obj interface{}) (*webhookConfig, bool) {
+		config, ok := obj.(*admitv1.MutatingWebhookConfiguration)
+		if !ok {
+			return nil, false
+		}
+		return w.mutatingConfig(config.DeepCopy()), true
+	}
+	mutating.informer = func(factory informers.SharedInformerFactory) cache.SharedIndexInformer {
+		return factory.Admissionregistration().V1().MutatingWebhookConfigurations().Informer()
+	}
+
+	validating := w.managed.validating
+	validating.get = func(ctx context.Context, name string) (*webhookConfig, error) {
+		config, err := w.client.ValidatingWebhookConfigurations().Get(ctx, name, metav1.GetOptions{}) //nolint:exhaustruct
+		if err != nil {
+			return nil, err
+		}
+		return w.validatingConfig(config), nil
+	}
+	validating.list = func(ctx context.Context, selector string) ([]*webhookConfig, error) {
+		list, err := w.client.ValidatingWebhookConfigurations().List(ctx, metav1.ListOptions{ //nolint:exhaustruct
+			LabelSelector: selector,
+		})
+		if err != nil {
+			return nil, err
+		}
+		configs := make([]*webhookConfig, 0, len(list.Items))
+		for i := range list.Items {
+			configs = append(configs, w.validatingConfig(&list.Items[i]))
+		}
+		return configs, nil
+	}
+	validating.wrap = func(obj interface{}) (*webhookConfig, bool) {
+		config, ok := obj.(*admitv1.ValidatingWebhookConfiguration)
+		if !ok {
+			return nil, false
+		}
+		return w.validatingConfig(config.DeepCopy()), true
+	}
+	validating.informer = func(factory informers.SharedInformerFactory) cache.SharedIndexInformer {
+		return factory.Admissionregistration().V1().ValidatingWebhookConfigurations().Informer()
+	}
+}
+
+func (w *MsmWebhook) mutatingConfig(config *admitv1.MutatingWebhookConfiguration) *webhookConfig {
+	c := &webhookConfig{
+		meta:     config,
+		object:   config,
+		webhooks: nil,
+		update: func(ctx context.Context) error {
+			_, err := w.client.MutatingWebhookConfigurations().Update(ctx, config, metav1.UpdateOptions{}) //nolint:exhaustruct
+			return err
+		},
+	}
+	for i := range config.Webhooks {
+		c.webhooks = append(c.webhooks, webhookClientConfig{
+			name:          config.Webhooks[i].Name,
+			config:        &config.Webhooks[i].ClientConfig,
+			failurePolicy: &config.Webhooks[i].FailurePolicy,
+		})
+	}
+	return c
+}
+
+func (w *MsmWebhook) validatingConfig(config *admitv1.ValidatingWebhookConfiguration) *webhookConfig {
+	c := &webhookConfig{
+		meta:     config,
+		object:   config,
+		webhooks: nil,
+		update: func(ctx context.Context) error {
+			_, err := w.client.ValidatingWebhookConfigurations().Update(ctx, config, metav1.UpdateOptions{}) //nolint:exhaustruct
+			return err
+		},
+	}
+	for i := range config.Webhooks {
+		c.webhooks = append(c.webhooks, webhookClientConfig{
+			name:          config.Webhooks[i].Name,
+			config:        &config.Webhooks[i].ClientConfig,
+			failurePolicy: &config.Webhooks[i].FailurePolicy,
+		})
+	}
+	return c
+}
+
+// manages tells whether the configuration is managed by name or selector
+func (k *webhookConfigKind) manages(meta metav1.Object) bool {
+	return slices.Contains(k.names, meta.GetName()) ||
+		(k.selector != nil && k.selector.Matches(labels.Set(meta.GetLabels())))
+}
+
+// resolve returns the names of the managed configurations of this kind
+func (k *webhookConfigKind) resolve(ctx context.Context) ([]string, error) {
+	names := slices.Clone(k.names)
+	if k.selector == nil {
+		return names, nil
+	}
+	configs, err := k.list(ctx, k.selector.String())
+	if err != nil {
+		return nil, fmt.Errorf("could not list %v matching %v: %w", k.kind, k.selector, err)
+	}
+	for _, c := range configs {
+		if !slices.Contains(names, c.meta.GetName()) {
+			names = append(names, c.meta.GetName())
+		}
+	}
+	return names, nil
+}
+
+// owned returns the client configs of the webhooks pointing at our Service
+func (w *MsmWebhook) owned(config *webhookConfig) []webhookClientConfig {
+	var owned []webhookClientConfig
+	for _, wh := range config.webhooks {
+		if w.ownsClientConfig(wh.config) {
+			owned = append(owned, wh)
+		}
+	}
+	return owned
+}
+
+func (w *MsmWebhook) ownsClientConfig(config *admitv1.WebhookClientConfig) bool {
+	s := config.Service
+	return s != nil && s.Namespace == w.namespace && s.Name == w.certOpts.serviceName
+}